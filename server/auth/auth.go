@@ -5,14 +5,14 @@ import (
 	"context"
 	"crypto/hmac"
 	"crypto/sha256"
-	"crypto/subtle"
 	"database/sql"
 	"encoding/base64"
 	"encoding/gob"
 	"errors"
 	"log"
-	"math/rand"
 	"reflect"
+	"sort"
+	"strconv"
 	"time"
 
 	"github.com/go-playground/validator/v10"
@@ -22,14 +22,18 @@ import (
 )
 
 const (
-	saltLen      = 12
-	checksumSize = 36
-	// SessionMaxAge is the max age of the session and should be used as the MaxAge property of the cookie.
-	SessionMaxAge = time.Hour * 48
+	checksumSize  = sha256.Size
+	userAgentSize = 255
 )
 
 var (
-	hmacKey []byte
+	// SessionIdleTimeout is how long a session lasts without being used.
+	SessionIdleTimeout = time.Hour * 48
+	// SessionLifetime is how long a session lasts after logging in, however much it is used.
+	SessionLifetime = time.Hour * 24 * 30
+	// SessionTouchInterval is the least time between refreshes of a session's last use, which
+	// saves writing the session on every request.
+	SessionTouchInterval = time.Minute * 5
 
 	// ErrBadLogin ...
 	ErrBadLogin = errors.New("Invalid email/password")
@@ -37,13 +41,22 @@ var (
 	ErrSessionExpired = errors.New("Session expired")
 	// ErrBadMAC ...
 	ErrBadMAC = errors.New("MAC does not match")
+	// ErrUnknownKey is returned for sessions signed with a key that isn't set, which are kept since
+	// they may still be valid on servers that have the key.
+	ErrUnknownKey = errors.New("Session signed with an unknown key")
 	// ErrUserExists ...
 	ErrUserExists = errors.New("A User with that email already exists")
+	// ErrNoSession ...
+	ErrNoSession = errors.New("Session not found")
 )
 
 func init() {
-	rand.Seed(time.Now().UnixNano())
-	hmacKey = randBytes(32)
+	// until keys are set, sessions are signed with a key that is lost on restart
+	k, err := GenerateKey()
+	if err != nil {
+		panic(err)
+	}
+	SetKeys(k)
 	gob.Register(User{})
 }
 
@@ -52,8 +65,37 @@ type (
 	User struct {
 		Email string
 	}
+
+	// Client describes who a session was created for, so that users can recognise their sessions.
+	Client struct {
+		UserAgent string
+		IP        string
+	}
+
+	// Session is the public view of a User's session. The ID is not the secret session id.
+	Session struct {
+		ID        int64     `json:"id"`
+		CreatedAt time.Time `json:"createdAt"`
+		LastSeen  time.Time `json:"lastSeen"`
+		UserAgent string    `json:"userAgent"`
+		IP        string    `json:"ip"`
+		Current   bool      `json:"current"`
+	}
+
+	userKey struct{}
 )
 
+// NewContext returns a copy of ctx carrying the logged in User.
+func NewContext(ctx context.Context, u *User) context.Context {
+	return context.WithValue(ctx, userKey{}, u)
+}
+
+// FromContext returns the logged in User stored in ctx by NewContext.
+func FromContext(ctx context.Context) (*User, bool) {
+	u, ok := ctx.Value(userKey{}).(*User)
+	return u, ok && u != nil
+}
+
 // PasswordValidator checks the password string for at least one lower, upper, digit and symbol character.
 func PasswordValidator(fl validator.FieldLevel) bool {
 	if fl.Field().Kind() != reflect.String {
@@ -87,167 +129,223 @@ func PasswordValidator(fl validator.FieldLevel) bool {
 	return false
 }
 
-func randBytes(len int) []byte {
-	bytes := make([]byte, len)
-	for i := 0; i < len; i++ {
-		b := rand.Intn(62) // 10 digits + 26 letters * 2
-		if b > 36 {
-			// lowercase
-			bytes[i] = byte(b + 60) // 'a' - 36
-		} else if b > 10 {
-			// uppercase
-			bytes[i] = byte(b + 55) // 'A' - 10
-		} else {
-			// digits
-			bytes[i] = byte(b + 48)
-		}
+// getSession returns the session contents, without the MAC, for the base64 encoded session id.
+// Sessions last SessionIdleTimeout since they were last used, which is refreshed at most every
+// SessionTouchInterval, up to SessionLifetime. maxAge is the remaining age of a refreshed session,
+// or 0 if it wasn't refreshed.
+func getSession(ctx context.Context, sidB64 string) (data []byte, maxAge time.Duration, err error) {
+	sid, err := base64.RawURLEncoding.DecodeString(sidB64)
+	if err != nil {
+		return nil, 0, ErrNoSession
 	}
-	return bytes
-}
-
-func hashPassword(b []byte) ([]byte, []byte) {
-	salt := randBytes(saltLen)
-	return salt, sha256.New().Sum(append(b, salt...))
-}
-
-func deleteSession(ctx context.Context, sid string) error {
-	return db.Pool.MustAffect(ctx, `
-		DELETE FROM sessions
-		WHERE [id] = ?;
-	`, sid)
-}
 
-func getSession(ctx context.Context, sidB64 []byte) (data []byte, err error) {
-	var sid []byte
-	var updatedAt time.Time
-	base64.StdEncoding.Decode(sid, sidB64)
-	err = db.Pool.QueryRowContext(ctx, `
-		SELECT [data], [updated_at]
-		FROM sessions
-		WHERE [id] = ?;
-	`, sid).Scan(&data, &updatedAt)
+	session, err := Store.Get(ctx, string(sid))
 	if err != nil {
-		return
+		return nil, 0, err
 	}
+	data, createdAt, updatedAt := session.Data, session.CreatedAt, session.UpdatedAt
 
-	if time.Now().After(updatedAt.Add(SessionMaxAge)) {
-		err = deleteSession(ctx, string(sid))
-		if err != nil {
+	now := time.Now().UTC().Truncate(time.Second)
+	if now.After(updatedAt.Add(SessionIdleTimeout)) || now.After(createdAt.Add(SessionLifetime)) {
+		err = Store.Delete(ctx, string(sid))
+		if err != nil && err != ErrNoSession {
 			log.Println("UNHANDLED:", err)
 		}
-		return nil, ErrSessionExpired
+		return nil, 0, ErrSessionExpired
 	}
 
 	macStart := len(data) - checksumSize
+	if macStart < 0 {
+		macStart = 0
+	}
 	contents := data[:macStart]
 	mac := data[macStart:]
 
-	hashed := getHMAC(append(contents, []byte(updatedAt.String())...))
-	if !hmac.Equal(hashed, mac) {
-		log.Println("deleting corrupted session:", sid)
-		err = deleteSession(ctx, string(sid))
-		if err != nil {
+	key, ok := verifyingKeys[session.KeyID]
+	if !ok {
+		// the key may only be missing on this server, e.g. while a rotated key file is rolled out, so
+		// the session is rejected but kept for servers that have it
+		log.Printf("rejecting session signed with unknown key %q\n", session.KeyID)
+		return nil, 0, ErrUnknownKey
+	}
+	if !hmac.Equal(sessionMAC(key, contents, updatedAt), mac) {
+		log.Println("deleting corrupted session:", string(sid))
+		err = Store.Delete(ctx, string(sid))
+		if err != nil && err != ErrNoSession {
 			log.Println("UNHANDLED:", err)
 		}
-		return nil, ErrBadMAC
+		return nil, 0, ErrBadMAC
 	}
-	return
+
+	if now.Sub(updatedAt) >= SessionTouchInterval {
+		if err = touchSession(ctx, string(sid), contents, updatedAt, now); err != nil {
+			log.Println("UNHANDLED:", err)
+		} else {
+			maxAge = CookieMaxAge(createdAt, now)
+		}
+	}
+	return contents, maxAge, nil
+}
+
+// touchSession marks the session as used at now, signing it again since the MAC covers the time.
+// It is signed with the current signing key, so active sessions move on to new keys.
+func touchSession(ctx context.Context, sid string, contents []byte, updatedAt, now time.Time) error {
+	data := append(append([]byte{}, contents...), sessionMAC(signingKey.Secret, contents, now)...)
+	err := Store.Touch(ctx, sid, signingKey.ID, data, updatedAt, now)
+	if err == ErrNoSession {
+		// a concurrent request has already touched it
+		return nil
+	}
+	return err
+}
+
+// CookieMaxAge is the MaxAge to use for the cookie of a session created at createdAt and last used
+// at now.
+func CookieMaxAge(createdAt, now time.Time) time.Duration {
+	maxAge := createdAt.Add(SessionLifetime).Sub(now)
+	if maxAge > SessionIdleTimeout {
+		maxAge = SessionIdleTimeout
+	}
+	return maxAge
+}
+
+func getHMAC(key, message []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(message)
+	return h.Sum(nil)
 }
 
-func getHMAC(message []byte) []byte {
-	h := hmac.New(sha256.New, hmacKey)
-	return h.Sum(message)
+// sessionMAC signs the session contents together with the time it was last updated.
+func sessionMAC(key, contents []byte, updatedAt time.Time) []byte {
+	return getHMAC(key, append(append([]byte{}, contents...), strconv.FormatInt(updatedAt.Unix(), 10)...))
 }
 
 // CreateUser creates a new user in the database, hashing the password.
 func CreateUser(ctx context.Context, email, password string) error {
-	res, err := db.Pool.ExecContext(ctx, `
-		SELECT NULL
-		FROM users
-		WHERE email = ?;
-	`, email)
+	hash, err := hashPassword(password)
 	if err != nil {
 		return err
-	} else if ra, err := res.RowsAffected(); err != nil {
-		return err
-	} else if ra != 0 {
-		return ErrUserExists
 	}
-
-	salt, hashedPass := hashPassword([]byte(password))
-	return db.Pool.MustAffect(ctx, `
+	err = db.Pool.MustAffect(ctx, `
 		INSERT INTO users (email, password)
 		VALUES (?, ?);
-	`, email, append(salt, hashedPass...))
+	`, email, hash)
+	if db.IsDuplicate(err) {
+		return ErrUserExists
+	}
+	return err
 }
 
-func setLoginAttempts(ctx context.Context, email string, attempts int) error {
+// setPassword replaces the User's password hash with a hash of password using PasswordParams.
+func setPassword(ctx context.Context, email, password string) error {
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
 	return db.Pool.MustAffect(ctx, `
 		UPDATE users
-		SET failed_attempts = ?;
-	`, attempts)
+		SET password = ?
+		WHERE email = ?;
+	`, hash, email)
 }
 
 // LogIn logs the User in by checking their password, recording failed attempts, and creating a session.
-func LogIn(ctx context.Context, email, password string) (string, error) {
+// It returns a *LockedError, without checking the password, while the account is locked, and
+// ErrUnverified for the right password until the email address is verified.
+func LogIn(ctx context.Context, email, password string, client Client) (string, error) {
 	var hashedPass []byte
 	var attempts int
+	var lockedUntil, verifiedAt *time.Time
 	err := db.Pool.QueryRowContext(ctx, `
-		SELECT password, failed_attempts
+		SELECT password, failed_attempts, locked_until, verified_at
 		FROM users
 		WHERE email = ?;
-	`, email).Scan(&hashedPass, &attempts)
+	`, email).Scan(&hashedPass, &attempts, &lockedUntil, &verifiedAt)
 	if err == sql.ErrNoRows {
+		// hashing anyway takes as long as checking a password, so unknown emails can't be told apart
+		hashPassword(password)
 		return "", ErrBadLogin
 	} else if err != nil {
 		return "", err
 	}
 
-	pwAndSalt := append([]byte(password), hashedPass[:saltLen]...)
+	// accounts unlock by themselves once locked_until has passed
+	if lockedUntil != nil && time.Now().Before(*lockedUntil) {
+		return "", &LockedError{Until: *lockedUntil}
+	}
 
-	if subtle.ConstantTimeCompare(sha256.New().Sum(pwAndSalt), hashedPass[saltLen:]) != 1 {
-		attempts++
-		if err = setLoginAttempts(ctx, email, attempts); err != nil {
+	ok, rehash, err := checkPassword(password, hashedPass)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		attempts, until, err := recordFailedLogin(ctx, email)
+		if err != nil {
 			log.Println("UNHANDLED:", err)
 		}
 		log.Printf("Failed login attempt %d for user: %s\n", attempts, email)
+		if !until.IsZero() {
+			log.Printf("Locked user %s until %s\n", email, until.Format(time.RFC3339))
+			return "", &LockedError{Until: until}
+		}
 		return "", ErrBadLogin
 	}
 
-	if err = setLoginAttempts(ctx, email, 0); err != nil {
-		log.Println("UNHANDLED:", err)
+	if attempts != 0 || lockedUntil != nil {
+		if err = Unlock(ctx, email); err != nil && err != db.ErrNoEffect {
+			log.Println("UNHANDLED:", err)
+		}
+	}
+
+	if rehash {
+		if err = setPassword(ctx, email, password); err != nil {
+			log.Println("UNHANDLED:", err)
+		}
+	}
+
+	if verifiedAt == nil {
+		return "", ErrUnverified
 	}
 
 	u := &User{Email: email}
 
-	sid, err := createSession(ctx, u)
+	sid, err := createSession(ctx, u, client)
 	if err != nil {
 		return "", err
 	}
 
-	var cookie []byte
-	base64.StdEncoding.Encode(cookie, []byte(sid))
-
-	return string(cookie), nil
+	return base64.RawURLEncoding.EncodeToString([]byte(sid)), nil
 }
 
-func createSession(ctx context.Context, u *User) (string, error) {
+func createSession(ctx context.Context, u *User, client Client) (string, error) {
 	sid, err := uuid.NewRandom()
 	if err != nil {
 		return "", err
 	}
 
-	timestamp := time.Now()
+	// DATETIME columns only store whole seconds
+	timestamp := time.Now().UTC().Truncate(time.Second)
 
 	data, err := encodeSession(u, timestamp)
 	if err != nil {
 		return "", err
 	}
 
-	err = db.Pool.MustAffect(ctx, `
-		INSERT INTO sessions (id, data, created_at, updated_at)
-		VAlUES (?, ?, ?, ?);
-	`, sid.String(), data, timestamp, timestamp)
+	userAgent := client.UserAgent
+	if len(userAgent) > userAgentSize {
+		userAgent = userAgent[:userAgentSize]
+	}
+
+	err = Store.Create(ctx, &SessionRecord{
+		ID:        sid.String(),
+		Email:     u.Email,
+		KeyID:     signingKey.ID,
+		Data:      data,
+		UserAgent: userAgent,
+		IP:        client.IP,
+		CreatedAt: timestamp,
+		UpdatedAt: timestamp,
+	})
 	if err != nil {
 		return "", err
 	}
@@ -263,22 +361,104 @@ func encodeSession(u *User, timestamp time.Time) ([]byte, error) {
 	}
 
 	gobData := buf.Bytes()
-	mac := getHMAC(append(gobData, []byte(timestamp.String())...))
+	return append(gobData, sessionMAC(signingKey.Secret, gobData, timestamp)...), nil
+}
+
+// GetUser decodes the session data and returns the User struct pointer. If using the session
+// refreshed it, maxAge is the new MaxAge for the cookie, otherwise it is 0.
+func GetUser(ctx context.Context, sid string) (u *User, maxAge time.Duration, err error) {
+	data, maxAge, err := getSession(ctx, sid)
+	if err != nil {
+		return nil, 0, err
+	}
 
-	return append(gobData, mac...), nil
+	u = &User{}
+	if err = gob.NewDecoder(bytes.NewReader(data)).Decode(u); err != nil {
+		return nil, 0, err
+	}
+	return u, maxAge, nil
 }
 
-// GetUser decodes the session data and returns the User struct pointer.
-func GetUser(ctx context.Context, sid string) (u *User, err error) {
-	data, err := getSession(ctx, []byte(sid))
+// LogOut deletes the session. It returns ErrNoSession if the session doesn't exist.
+func LogOut(ctx context.Context, sidB64 string) error {
+	sid, err := base64.RawURLEncoding.DecodeString(sidB64)
 	if err != nil {
-		return
+		return ErrNoSession
 	}
 
-	var buf bytes.Buffer
-	buf.Write(data)
-	decoder := gob.NewDecoder(&buf)
+	return Store.Delete(ctx, string(sid))
+}
+
+// active reports whether the session hasn't expired at now.
+func active(s *SessionRecord, now time.Time) bool {
+	return !now.After(s.UpdatedAt.Add(SessionIdleTimeout)) && !now.After(s.CreatedAt.Add(SessionLifetime))
+}
+
+// decodeSID decodes a session id from a cookie, returning "" if it is malformed.
+func decodeSID(sidB64 string) string {
+	sid, err := base64.RawURLEncoding.DecodeString(sidB64)
+	if err != nil {
+		return ""
+	}
+	return string(sid)
+}
+
+// Sessions lists the User's active sessions, most recently seen first. The session with the
+// current session id is marked as Current.
+func Sessions(ctx context.Context, email, currentSID string) ([]*Session, error) {
+	current := decodeSID(currentSID)
+
+	records, err := Store.List(ctx, email)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(records, func(i, j int) bool {
+		if !records[i].UpdatedAt.Equal(records[j].UpdatedAt) {
+			return records[i].UpdatedAt.After(records[j].UpdatedAt)
+		}
+		return records[i].PublicID > records[j].PublicID
+	})
+
+	now := time.Now()
+	sessions := []*Session{}
+	for _, r := range records {
+		if !active(r, now) {
+			continue
+		}
+		sessions = append(sessions, &Session{
+			ID:        r.PublicID,
+			CreatedAt: r.CreatedAt,
+			LastSeen:  r.UpdatedAt,
+			UserAgent: r.UserAgent,
+			IP:        r.IP,
+			Current:   r.ID == current,
+		})
+	}
+	return sessions, nil
+}
+
+// RevokeSession deletes one of the User's sessions by its public id, and reports whether it was
+// the one with the current session id. It returns ErrNoSession if the User has no such session.
+func RevokeSession(ctx context.Context, email string, id int64, currentSID string) (current bool, err error) {
+	records, err := Store.List(ctx, email)
+	if err != nil {
+		return false, err
+	}
+	for _, r := range records {
+		if r.PublicID == id {
+			return r.ID == decodeSID(currentSID), Store.Delete(ctx, r.ID)
+		}
+	}
+	return false, ErrNoSession
+}
+
+// RevokeSessions deletes all of the User's sessions, logging them out everywhere.
+func RevokeSessions(ctx context.Context, email string) error {
+	return Store.DeleteByUser(ctx, email)
+}
 
-	decoder.Decode(&u)
-	return
+// PurgeSessions deletes expired sessions from the Store, returning how many were deleted.
+func PurgeSessions(ctx context.Context) (int64, error) {
+	now := time.Now().UTC()
+	return Store.DeleteExpired(ctx, now.Add(-SessionIdleTimeout), now.Add(-SessionLifetime))
 }
@@ -0,0 +1,75 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"testing"
+	"time"
+)
+
+func TestCookieMaxAge(t *testing.T) {
+	defer func(idle, lifetime time.Duration) {
+		SessionIdleTimeout, SessionLifetime = idle, lifetime
+	}(SessionIdleTimeout, SessionLifetime)
+	SessionIdleTimeout, SessionLifetime = time.Hour, 24*time.Hour
+
+	created := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	cases := []struct {
+		since time.Duration
+		want  time.Duration
+	}{
+		{0, time.Hour},
+		{22 * time.Hour, time.Hour},
+		{23*time.Hour + 30*time.Minute, 30 * time.Minute},
+	}
+
+	for _, tc := range cases {
+		if got := CookieMaxAge(created, created.Add(tc.since)); got != tc.want {
+			t.Errorf("%s after login: got %s; want %s", tc.since, got, tc.want)
+		}
+	}
+}
+
+func TestGetSessionMAC(t *testing.T) {
+	defer func(s SessionStore) { Store = s }(Store)
+	Store = NewMemoryStore()
+	key := Key{ID: "k", Secret: bytes.Repeat([]byte{1}, 32)}
+	if err := SetKeys(key); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	now := time.Now().UTC().Truncate(time.Second)
+	contents := []byte("user")
+	cases := []struct {
+		id    string
+		keyID string
+		mac   []byte
+		err   error
+		kept  bool
+	}{
+		{"valid", "k", sessionMAC(key.Secret, contents, now), nil, true},
+		// sessions signed with a key this server doesn't have may be valid on others
+		{"unknown key", "gone", sessionMAC(key.Secret, contents, now), ErrUnknownKey, true},
+		{"forged", "k", sessionMAC([]byte("other"), contents, now), ErrBadMAC, false},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.id, func(t *testing.T) {
+			rec := &SessionRecord{ID: tc.id, Email: "a@b.c", KeyID: tc.keyID, Data: append(contents, tc.mac...),
+				CreatedAt: now, UpdatedAt: now}
+			if err := Store.Create(ctx, rec); err != nil {
+				t.Fatal(err)
+			}
+
+			got, _, err := getSession(ctx, base64.RawURLEncoding.EncodeToString([]byte(tc.id)))
+			if err != tc.err || (err == nil && !bytes.Equal(got, contents)) {
+				t.Fatalf("got %q, %v; want %q, %v", got, err, contents, tc.err)
+			}
+			if _, err = Store.Get(ctx, tc.id); (err == nil) != tc.kept {
+				t.Fatalf("got %v getting the session; want kept %t", err, tc.kept)
+			}
+		})
+	}
+}
@@ -0,0 +1,141 @@
+package auth
+
+import (
+	"context"
+	"encoding/gob"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// FileStore keeps sessions in memory like MemoryStore, and writes them all to a file after every
+// change so that they survive restarts. It is meant for development: since every login, refresh
+// and logout rewrites the whole file while holding the store's lock, it gets slow as sessions pile
+// up. Use SQLStore in production.
+type FileStore struct {
+	// mu serializes changes with writing them, so that the file is never older than memory
+	mu   sync.Mutex
+	mem  *MemoryStore
+	path string
+}
+
+type fileSnapshot struct {
+	LastID   int64
+	Sessions map[string]*SessionRecord
+}
+
+// OpenFileStore loads the sessions in the file at path, which is created on the first change if it
+// doesn't exist.
+func OpenFileStore(path string) (*FileStore, error) {
+	f := &FileStore{mem: NewMemoryStore(), path: path}
+
+	file, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return f, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var snapshot fileSnapshot
+	if err = gob.NewDecoder(file).Decode(&snapshot); err != nil {
+		return nil, err
+	}
+	if snapshot.Sessions != nil {
+		f.mem.sessions = snapshot.Sessions
+	}
+	f.mem.lastID = snapshot.LastID
+	return f, nil
+}
+
+// save writes the sessions to a temporary file and renames it over the store's file, so a crash
+// can't leave it half written.
+func (f *FileStore) save() error {
+	f.mem.mu.Lock()
+	snapshot := fileSnapshot{LastID: f.mem.lastID, Sessions: f.mem.sessions}
+	defer f.mem.mu.Unlock()
+
+	tmp, err := os.CreateTemp(filepath.Dir(f.path), filepath.Base(f.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err = gob.NewEncoder(tmp).Encode(&snapshot); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), f.path)
+}
+
+// Create implements SessionStore.
+func (f *FileStore) Create(ctx context.Context, s *SessionRecord) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.mem.Create(ctx, s); err != nil {
+		return err
+	}
+	return f.save()
+}
+
+// Get implements SessionStore.
+func (f *FileStore) Get(ctx context.Context, id string) (*SessionRecord, error) {
+	return f.mem.Get(ctx, id)
+}
+
+// Touch implements SessionStore.
+func (f *FileStore) Touch(ctx context.Context, id, keyID string, data []byte, updatedAt, now time.Time) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.mem.Touch(ctx, id, keyID, data, updatedAt, now); err != nil {
+		return err
+	}
+	return f.save()
+}
+
+// Delete implements SessionStore.
+func (f *FileStore) Delete(ctx context.Context, id string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.mem.Delete(ctx, id); err != nil {
+		return err
+	}
+	return f.save()
+}
+
+// DeleteByUser implements SessionStore.
+func (f *FileStore) DeleteByUser(ctx context.Context, email string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.mem.DeleteByUser(ctx, email); err != nil {
+		return err
+	}
+	return f.save()
+}
+
+// List implements SessionStore.
+func (f *FileStore) List(ctx context.Context, email string) ([]*SessionRecord, error) {
+	return f.mem.List(ctx, email)
+}
+
+// DeleteExpired implements SessionStore.
+func (f *FileStore) DeleteExpired(ctx context.Context, idleBefore, createdBefore time.Time) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	n, err := f.mem.DeleteExpired(ctx, idleBefore, createdBefore)
+	if err != nil || n == 0 {
+		return n, err
+	}
+	return n, f.save()
+}
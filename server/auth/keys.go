@@ -0,0 +1,177 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// minKeySize is the least number of bytes in a signing key, the size of a SHA-256 hash.
+const minKeySize = 32
+
+// Key is a secret for signing sessions. The ID is stored with each session, so that sessions
+// signed with an older key can still be verified after a new key is added.
+type Key struct {
+	ID     string
+	Secret []byte
+}
+
+var (
+	// signingKey signs new and refreshed sessions
+	signingKey Key
+	// verifyingKeys verify sessions by the id of the key they were signed with
+	verifyingKeys map[string][]byte
+
+	// ErrNoKeys is returned by SetKeys without any keys, since sessions can't be signed then.
+	ErrNoKeys = errors.New("No session keys")
+)
+
+// GenerateKey returns a new random Key.
+func GenerateKey() (Key, error) {
+	id := make([]byte, 4)
+	secret := make([]byte, minKeySize)
+	if _, err := rand.Read(id); err != nil {
+		return Key{}, err
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return Key{}, err
+	}
+	return Key{ID: hex.EncodeToString(id), Secret: secret}, nil
+}
+
+// SetKeys sets the keys used for sessions. The first key signs sessions, and all of them verify
+// sessions. Sessions signed with a key that is not set are rejected with ErrUnknownKey.
+func SetKeys(keys ...Key) error {
+	if len(keys) == 0 {
+		return ErrNoKeys
+	}
+
+	byID := map[string][]byte{}
+	for _, k := range keys {
+		if k.ID == "" || strings.ContainsAny(k.ID, " \t:,") {
+			return fmt.Errorf("invalid session key id %q", k.ID)
+		}
+		if len(k.Secret) < minKeySize {
+			return fmt.Errorf("session key %s is shorter than %d bytes", k.ID, minKeySize)
+		}
+		if _, ok := byID[k.ID]; ok {
+			return fmt.Errorf("duplicate session key id %s", k.ID)
+		}
+		byID[k.ID] = k.Secret
+	}
+
+	signingKey, verifyingKeys = keys[0], byID
+	return nil
+}
+
+// ParseKeys parses keys written as "id:secret" pairs, with base64 encoded secrets, separated by
+// commas, like the SESSION_KEYS environment variable.
+func ParseKeys(s string) ([]Key, error) {
+	var keys []Key
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		k, err := parseKey(strings.SplitN(pair, ":", 2))
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+func parseKey(fields []string) (Key, error) {
+	if len(fields) != 2 {
+		return Key{}, errors.New("session keys must be an id and a secret")
+	}
+	secret, err := base64.StdEncoding.DecodeString(fields[1])
+	if err != nil {
+		return Key{}, fmt.Errorf("session key %s: %w", fields[0], err)
+	}
+	return Key{ID: fields[0], Secret: secret}, nil
+}
+
+// ReadKeys reads keys written by WriteKeys, one "id secret" pair per line with a base64 encoded
+// secret. Blank lines and lines starting with "#" are skipped.
+func ReadKeys(r io.Reader) ([]Key, error) {
+	var keys []Key
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		k, err := parseKey(strings.Fields(line))
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, scanner.Err()
+}
+
+// WriteKeys writes the keys in the format read by ReadKeys.
+func WriteKeys(w io.Writer, keys []Key) error {
+	if _, err := fmt.Fprintln(w, "# session keys, the first one signs sessions"); err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if _, err := fmt.Fprintf(w, "%s %s\n", k.ID, base64.StdEncoding.EncodeToString(k.Secret)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadKeyFile reads the keys in the file at path, see ReadKeys.
+func ReadKeyFile(path string) ([]Key, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadKeys(f)
+}
+
+// RotateKeyFile adds a new signing key to the start of the key file at path, creating it if it
+// doesn't exist, and keeps at most keep of the keys that were there. It returns the new key.
+func RotateKeyFile(path string, keep int) (Key, error) {
+	keys, err := ReadKeyFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return Key{}, err
+	}
+	if len(keys) > keep {
+		keys = keys[:keep]
+	}
+
+	k, err := GenerateKey()
+	if err != nil {
+		return Key{}, err
+	}
+	keys = append([]Key{k}, keys...)
+
+	// the keys are written to a temporary file first, so a failure can't lose the old keys
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return Key{}, err
+	}
+	defer os.Remove(tmp)
+
+	if err = WriteKeys(f, keys); err != nil {
+		f.Close()
+		return Key{}, err
+	}
+	if err = f.Close(); err != nil {
+		return Key{}, err
+	}
+	return k, os.Rename(tmp, path)
+}
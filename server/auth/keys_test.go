@@ -0,0 +1,49 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSessionKeys(t *testing.T) {
+	path := t.TempDir() + "/keys"
+	var latest Key
+	for i := 0; i < 4; i++ {
+		k, err := RotateKeyFile(path, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		latest = k
+	}
+
+	keys, err := ReadKeyFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 3 || keys[0].ID != latest.ID || !bytes.Equal(keys[0].Secret, latest.Secret) {
+		t.Fatalf("got %d keys starting with %s; want 3 starting with %s", len(keys), keys[0].ID, latest.ID)
+	}
+	if err = SetKeys(keys...); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf strings.Builder
+	for _, k := range keys {
+		fmt.Fprintf(&buf, "%s:%s,", k.ID, base64.StdEncoding.EncodeToString(k.Secret))
+	}
+	parsed, err := ParseKeys(buf.String())
+	if err != nil || !reflect.DeepEqual(parsed, keys) {
+		t.Fatalf("got %v, %v parsing keys; want the same keys", parsed, err)
+	}
+
+	if err = SetKeys(Key{ID: "short", Secret: []byte("secret")}); err == nil {
+		t.Fatal("got no error setting a short key")
+	}
+	if err = SetKeys(); err != ErrNoKeys {
+		t.Fatalf("got %v setting no keys; want %v", err, ErrNoKeys)
+	}
+}
@@ -0,0 +1,101 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/calvinsomething/go-proj/db"
+)
+
+var (
+	// LockoutThreshold is the number of failed logins in a row that locks an account. 0 disables
+	// lockouts.
+	LockoutThreshold = 5
+	// LockoutBase is how long an account is locked when it reaches LockoutThreshold. Each failed
+	// login after that doubles it, up to LockoutMax.
+	LockoutBase = time.Minute
+	// LockoutMax is the longest an account is locked.
+	LockoutMax = time.Hour * 24
+
+	// ErrLocked matches every *LockedError with errors.Is.
+	ErrLocked = errors.New("Account locked")
+)
+
+// LockedError is returned by LogIn for accounts locked after too many failed logins.
+type LockedError struct {
+	Until time.Time
+}
+
+func (e *LockedError) Error() string {
+	return fmt.Sprintf("Account locked until %s", e.Until.Format(time.RFC3339))
+}
+
+// Is makes LockedErrors match ErrLocked.
+func (e *LockedError) Is(target error) bool {
+	return target == ErrLocked
+}
+
+// lockoutFor returns how long an account is locked after its failed attempts in a row.
+func lockoutFor(attempts int) time.Duration {
+	if LockoutThreshold <= 0 || attempts < LockoutThreshold {
+		return 0
+	}
+	d := LockoutBase
+	for i := LockoutThreshold; i < attempts && d < LockoutMax; i++ {
+		d *= 2
+	}
+	if d > LockoutMax {
+		d = LockoutMax
+	}
+	return d
+}
+
+// recordFailedLogin counts a failed login for the User, locking the account if there have been too
+// many in a row. The count is read and written in one transaction, so that concurrent failed logins
+// are all counted. It returns the failed attempts in a row and when the account is locked until,
+// which is zero if it isn't.
+func recordFailedLogin(ctx context.Context, email string) (attempts int, until time.Time, err error) {
+	err = db.Pool.InTx(ctx, func(tx *sql.Tx) error {
+		err := tx.QueryRowContext(ctx, `
+			SELECT failed_attempts
+			FROM users
+			WHERE email = ?
+			FOR UPDATE;
+		`, email).Scan(&attempts)
+		if err != nil {
+			return err
+		}
+		attempts++
+
+		var lockedUntil *time.Time
+		if d := lockoutFor(attempts); d > 0 {
+			// DATETIME columns only store whole seconds, so round up to not unlock early
+			until = time.Now().UTC().Add(d + time.Second).Truncate(time.Second)
+			lockedUntil = &until
+		}
+
+		_, err = tx.ExecContext(ctx, `
+			UPDATE users
+			SET failed_attempts = ?, locked_until = ?
+			WHERE email = ?;
+		`, attempts, lockedUntil, email)
+		return err
+	})
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	return attempts, until, nil
+}
+
+// Unlock clears the User's failed logins and lockout. It returns db.ErrNoEffect if there was
+// nothing to clear.
+func Unlock(ctx context.Context, email string) error {
+	return db.Pool.MustAffect(ctx, `
+		UPDATE users
+		SET failed_attempts = 0, locked_until = NULL
+		WHERE email = ? AND (failed_attempts != 0 OR locked_until IS NOT NULL);
+	`, email)
+}
@@ -0,0 +1,38 @@
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLockoutFor(t *testing.T) {
+	defer func(threshold int, base, max time.Duration) {
+		LockoutThreshold, LockoutBase, LockoutMax = threshold, base, max
+	}(LockoutThreshold, LockoutBase, LockoutMax)
+
+	cases := []struct {
+		threshold int
+		attempts  int
+		want      time.Duration
+	}{
+		{3, 0, 0},
+		{3, 2, 0},
+		{3, 3, time.Minute},
+		{3, 4, 2 * time.Minute},
+		{3, 6, 8 * time.Minute},
+		// capped at LockoutMax, even when doubling would pass it
+		{3, 7, 10 * time.Minute},
+		{3, 1000, 10 * time.Minute},
+		{1, 1, time.Minute},
+		{0, 1000, 0},
+		{-1, 1000, 0},
+	}
+
+	LockoutBase, LockoutMax = time.Minute, 10*time.Minute
+	for _, tc := range cases {
+		LockoutThreshold = tc.threshold
+		if got := lockoutFor(tc.attempts); got != tc.want {
+			t.Errorf("threshold %d, %d attempts: got %s; want %s", tc.threshold, tc.attempts, got, tc.want)
+		}
+	}
+}
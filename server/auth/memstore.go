@@ -0,0 +1,119 @@
+package auth
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// MemoryStore keeps sessions in memory, for tests and running a single server in development.
+// Sessions are lost when the server stops.
+type MemoryStore struct {
+	mu       sync.Mutex
+	sessions map[string]*SessionRecord
+	lastID   int64
+}
+
+// NewMemoryStore returns an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{sessions: map[string]*SessionRecord{}}
+}
+
+// copySession returns a copy of s that doesn't share its Data.
+func copySession(s *SessionRecord) *SessionRecord {
+	c := *s
+	c.Data = append([]byte{}, s.Data...)
+	return &c
+}
+
+// Create implements SessionStore.
+func (m *MemoryStore) Create(ctx context.Context, s *SessionRecord) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.lastID++
+	s.PublicID = m.lastID
+	m.sessions[s.ID] = copySession(s)
+	return nil
+}
+
+// Get implements SessionStore.
+func (m *MemoryStore) Get(ctx context.Context, id string) (*SessionRecord, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, ok := m.sessions[id]
+	if !ok {
+		return nil, ErrNoSession
+	}
+	return copySession(s), nil
+}
+
+// Touch implements SessionStore.
+func (m *MemoryStore) Touch(ctx context.Context, id, keyID string, data []byte, updatedAt, now time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, ok := m.sessions[id]
+	if !ok || !s.UpdatedAt.Equal(updatedAt) {
+		return ErrNoSession
+	}
+	s.KeyID = keyID
+	s.Data = append([]byte{}, data...)
+	s.UpdatedAt = now
+	return nil
+}
+
+// Delete implements SessionStore.
+func (m *MemoryStore) Delete(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.sessions[id]; !ok {
+		return ErrNoSession
+	}
+	delete(m.sessions, id)
+	return nil
+}
+
+// DeleteByUser implements SessionStore.
+func (m *MemoryStore) DeleteByUser(ctx context.Context, email string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for id, s := range m.sessions {
+		if s.Email == email {
+			delete(m.sessions, id)
+		}
+	}
+	return nil
+}
+
+// List implements SessionStore.
+func (m *MemoryStore) List(ctx context.Context, email string) ([]*SessionRecord, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var sessions []*SessionRecord
+	for _, s := range m.sessions {
+		if s.Email == email {
+			sessions = append(sessions, copySession(s))
+		}
+	}
+	return sessions, nil
+}
+
+// DeleteExpired implements SessionStore.
+func (m *MemoryStore) DeleteExpired(ctx context.Context, idleBefore, createdBefore time.Time) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var n int64
+	for id, s := range m.sessions {
+		if s.UpdatedAt.Before(idleBefore) || s.CreatedAt.Before(createdBefore) {
+			delete(m.sessions, id)
+			n++
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,103 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// legacySaltLen is the length of the salt at the start of legacy password hashes.
+const legacySaltLen = 12
+
+// Argon2Params are the costs of hashing passwords with argon2id.
+type Argon2Params struct {
+	// Memory is in KiB.
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+	SaltLen     uint32
+	KeyLen      uint32
+}
+
+var (
+	// PasswordParams are used to hash new passwords. Passwords hashed with other params are hashed
+	// again when their users log in.
+	PasswordParams = Argon2Params{Memory: 19 * 1024, Iterations: 2, Parallelism: 1, SaltLen: 16, KeyLen: 32}
+
+	errBadHash = errors.New("Invalid password hash")
+)
+
+// hashPassword hashes the password with argon2id and PasswordParams, in the PHC string format.
+func hashPassword(password string) ([]byte, error) {
+	p := PasswordParams
+	salt := make([]byte, p.SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, p.Iterations, p.Memory, p.Parallelism, p.KeyLen)
+	return []byte(fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, p.Memory, p.Iterations,
+		p.Parallelism, base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))), nil
+}
+
+// checkPassword reports whether the password matches the hash, and whether the hash should be
+// replaced because it isn't argon2id with PasswordParams. Besides argon2id, bcrypt and the legacy
+// salted SHA-256 hashes are checked.
+func checkPassword(password string, hash []byte) (ok, rehash bool, err error) {
+	switch {
+	case strings.HasPrefix(string(hash), "$argon2id$"):
+		p, salt, key, err := parseArgon2(string(hash))
+		if err != nil {
+			return false, false, err
+		}
+		other := argon2.IDKey([]byte(password), salt, p.Iterations, p.Memory, p.Parallelism, p.KeyLen)
+		return subtle.ConstantTimeCompare(key, other) == 1, p != PasswordParams, nil
+	case strings.HasPrefix(string(hash), "$2"):
+		err = bcrypt.CompareHashAndPassword(hash, []byte(password))
+		if err == bcrypt.ErrMismatchedHashAndPassword {
+			return false, false, nil
+		}
+		return err == nil, true, err
+	case len(hash) > legacySaltLen:
+		// legacy hashes are the salt followed by sha256.New().Sum(password + salt), which appends the
+		// SHA-256 of nothing to the password and salt rather than hashing them
+		salt := hash[:legacySaltLen]
+		legacy := sha256.New().Sum(append([]byte(password), salt...))
+		return subtle.ConstantTimeCompare(legacy, hash[legacySaltLen:]) == 1, true, nil
+	}
+	return false, false, errBadHash
+}
+
+// parseArgon2 parses an argon2id hash in the PHC string format made by hashPassword.
+func parseArgon2(hash string) (p Argon2Params, salt, key []byte, err error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return p, nil, nil, errBadHash
+	}
+
+	var version int
+	if _, err = fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return p, nil, nil, errBadHash
+	}
+	// argon2.IDKey panics without iterations or parallelism, and zero costs are never made by hashPassword
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Iterations, &p.Parallelism)
+	if err != nil || p.Memory == 0 || p.Iterations == 0 || p.Parallelism == 0 {
+		return p, nil, nil, errBadHash
+	}
+	if salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return p, nil, nil, errBadHash
+	}
+	// an empty key would match any password
+	if key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil || len(key) == 0 {
+		return p, nil, nil, errBadHash
+	}
+	p.SaltLen, p.KeyLen = uint32(len(salt)), uint32(len(key))
+	return p, salt, key, nil
+}
@@ -0,0 +1,65 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestCheckPassword(t *testing.T) {
+	defer func(p Argon2Params) { PasswordParams = p }(PasswordParams)
+	PasswordParams = Argon2Params{Memory: 64, Iterations: 1, Parallelism: 1, SaltLen: 16, KeyLen: 32}
+
+	argon, err := hashPassword("Secret1!")
+	if err != nil {
+		t.Fatal(err)
+	}
+	PasswordParams.Iterations = 2
+	outdated, err := hashPassword("Secret1!")
+	if err != nil {
+		t.Fatal(err)
+	}
+	PasswordParams.Iterations = 1
+
+	bcrypted, err := bcrypt.GenerateFromPassword([]byte("Secret1!"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	salt := []byte("0123456789ab")
+	legacy := append(append([]byte{}, salt...), sha256.New().Sum(append([]byte("Secret1!"), salt...))...)
+
+	cases := []struct {
+		name     string
+		password string
+		hash     []byte
+		ok       bool
+		rehash   bool
+		err      error
+	}{
+		{"argon2id", "Secret1!", argon, true, false, nil},
+		{"argon2id wrong password", "Secret2!", argon, false, false, nil},
+		{"argon2id other params", "Secret1!", outdated, true, true, nil},
+		{"bcrypt", "Secret1!", bcrypted, true, true, nil},
+		{"bcrypt wrong password", "Secret2!", bcrypted, false, false, nil},
+		{"legacy", "Secret1!", legacy, true, true, nil},
+		{"legacy wrong password", "Secret2!", legacy, false, true, nil},
+		{"too short", "Secret1!", []byte("short"), false, false, errBadHash},
+		{"missing parts", "Secret1!", []byte("$argon2id$v=19$m=64,t=1,p=1$c2FsdA"), false, false, errBadHash},
+		{"other version", "Secret1!", []byte("$argon2id$v=16$m=64,t=1,p=1$c2FsdA$a2V5"), false, false, errBadHash},
+		{"no iterations", "Secret1!", []byte("$argon2id$v=19$m=64,t=0,p=1$c2FsdA$a2V5"), false, false, errBadHash},
+		{"no parallelism", "Secret1!", []byte("$argon2id$v=19$m=64,t=1,p=0$c2FsdA$a2V5"), false, false, errBadHash},
+		{"no memory", "Secret1!", []byte("$argon2id$v=19$m=0,t=1,p=1$c2FsdA$a2V5"), false, false, errBadHash},
+		{"bad salt", "Secret1!", []byte("$argon2id$v=19$m=64,t=1,p=1$!!$a2V5"), false, false, errBadHash},
+		{"empty key", "Secret1!", []byte("$argon2id$v=19$m=64,t=1,p=1$c2FsdA$"), false, false, errBadHash},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			ok, rehash, err := checkPassword(tc.password, tc.hash)
+			if ok != tc.ok || rehash != tc.rehash || err != tc.err {
+				t.Fatalf("got %t, %t, %v; want %t, %t, %v", ok, rehash, err, tc.ok, tc.rehash, tc.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,145 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"time"
+
+	"github.com/calvinsomething/go-proj/db"
+)
+
+// resetTokenSize is the number of random bytes in a password reset token.
+const resetTokenSize = 32
+
+var (
+	// PasswordResetTTL is how long a password reset token is valid.
+	PasswordResetTTL = time.Hour
+	// PasswordResetInterval is the least time between making password reset tokens for a User.
+	PasswordResetInterval = time.Minute
+
+	// ErrNoReset is returned by PasswordResetToken when there is no User with the email, or they
+	// were given a token less than PasswordResetInterval ago. The two aren't told apart, and take the
+	// same query, so that neither can be used to find users.
+	ErrNoReset = errors.New("No password reset token made")
+)
+
+// newResetToken returns a random password reset token and the hash of it that is stored.
+func newResetToken() (token string, hash []byte, err error) {
+	raw := make([]byte, resetTokenSize)
+	if _, err = rand.Read(raw); err != nil {
+		return "", nil, err
+	}
+	sum := sha256.Sum256(raw)
+	return base64.RawURLEncoding.EncodeToString(raw), sum[:], nil
+}
+
+// resetTokenHash returns the stored hash of a token from newResetToken, or ErrBadToken if it
+// can't be one.
+func resetTokenHash(token string) ([]byte, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || len(raw) != resetTokenSize {
+		return nil, ErrBadToken
+	}
+	sum := sha256.Sum256(raw)
+	return sum[:], nil
+}
+
+// PasswordResetToken returns a single use token to send to the User's email address, which
+// ResetPassword accepts. Only its hash is stored. It returns ErrNoReset if there is no such User or
+// they were given a token too recently.
+func PasswordResetToken(ctx context.Context, email string) (string, error) {
+	token, hash, err := newResetToken()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+
+	err = db.Pool.MustAffect(ctx, `
+		INSERT INTO password_resets (token_hash, user_email, created_at, expires_at)
+		SELECT ?, email, ?, ?
+		FROM users
+		WHERE email = ? AND NOT EXISTS (
+			SELECT 1
+			FROM password_resets
+			WHERE user_email = ? AND created_at > ?
+		);
+	`, hash, now, now.Add(PasswordResetTTL), email, email, now.Add(-PasswordResetInterval))
+	if err == db.ErrNoEffect {
+		return "", ErrNoReset
+	} else if err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// ResetPassword sets the password of the User the token from PasswordResetToken was made for, and
+// logs them out everywhere. The token, and any others for the User, can't be used again. Since the
+// User has shown they own the email address, it is verified and the account is unlocked.
+func ResetPassword(ctx context.Context, token, password string) error {
+	tokenHash, err := resetTokenHash(token)
+	if err != nil {
+		return err
+	}
+
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	var email string
+	err = db.Pool.InTx(ctx, func(tx *sql.Tx) error {
+		var expiresAt time.Time
+		err := tx.QueryRowContext(ctx, `
+			SELECT user_email, expires_at
+			FROM password_resets
+			WHERE token_hash = ?
+			FOR UPDATE;
+		`, tokenHash).Scan(&email, &expiresAt)
+		if err == sql.ErrNoRows {
+			// the token was used already, or another one for the User was
+			return ErrBadToken
+		} else if err != nil {
+			return err
+		}
+		now := time.Now().UTC()
+		if now.After(expiresAt) {
+			return ErrTokenExpired
+		}
+
+		if _, err = tx.ExecContext(ctx, `
+			UPDATE users
+			SET password = ?, failed_attempts = 0, locked_until = NULL, verified_at = COALESCE(verified_at, ?)
+			WHERE email = ?;
+		`, hash, now, email); err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, `
+			DELETE FROM password_resets
+			WHERE user_email = ?;
+		`, email)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return RevokeSessions(ctx, email)
+}
+
+// PurgePasswordResets deletes expired password reset tokens, returning how many were deleted.
+func PurgePasswordResets(ctx context.Context) (int64, error) {
+	res, err := db.Pool.ExecContext(ctx, `
+		DELETE FROM password_resets
+		WHERE expires_at < ?;
+	`, time.Now().UTC())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
@@ -0,0 +1,177 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/calvinsomething/go-proj/db"
+)
+
+func TestResetToken(t *testing.T) {
+	token, hash, err := newResetToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _, err := newResetToken()
+	if err != nil || other == token {
+		t.Fatalf("got %q, %v making another token; want a different token", other, err)
+	}
+
+	got, err := resetTokenHash(token)
+	if err != nil || !bytes.Equal(got, hash) {
+		t.Fatalf("got %x, %v; want %x", got, err, hash)
+	}
+
+	for _, bad := range []string{
+		"",
+		"not base64!",
+		base64.RawURLEncoding.EncodeToString(make([]byte, resetTokenSize-1)),
+		base64.StdEncoding.EncodeToString(make([]byte, resetTokenSize)),
+		token + "A",
+	} {
+		if _, err := resetTokenHash(bad); err != ErrBadToken {
+			t.Errorf("%q: got %v; want %v", bad, err, ErrBadToken)
+		}
+	}
+}
+
+// resetDB is a database/sql driver that keeps password resets in memory, answering the queries
+// ResetPassword makes, so that the reset flow can be tested without MySQL.
+type resetDB struct {
+	mu        sync.Mutex
+	expiry    map[string]time.Time // by token hash
+	owner     map[string]string    // email by token hash
+	passwords map[string][]byte    // by email
+}
+
+func (d *resetDB) Open(string) (driver.Conn, error) { return resetConn{d}, nil }
+
+type resetConn struct{ d *resetDB }
+
+func (c resetConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, fmt.Errorf("unexpected prepare %q", query)
+}
+func (c resetConn) Close() error              { return nil }
+func (c resetConn) Begin() (driver.Tx, error) { return c, nil }
+func (c resetConn) Commit() error             { return nil }
+func (c resetConn) Rollback() error           { return nil }
+
+func (c resetConn) QueryContext(_ context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if !strings.Contains(query, "FROM password_resets") {
+		return nil, fmt.Errorf("unexpected query %q", query)
+	}
+	c.d.mu.Lock()
+	defer c.d.mu.Unlock()
+	hash := string(args[0].Value.([]byte))
+	rows := &resetRows{}
+	if email, ok := c.d.owner[hash]; ok {
+		rows.values = [][]driver.Value{{email, c.d.expiry[hash]}}
+	}
+	return rows, nil
+}
+
+func (c resetConn) ExecContext(_ context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	c.d.mu.Lock()
+	defer c.d.mu.Unlock()
+	switch {
+	case strings.Contains(query, "UPDATE users"):
+		c.d.passwords[args[2].Value.(string)] = args[0].Value.([]byte)
+	case strings.Contains(query, "DELETE FROM password_resets"):
+		for hash, email := range c.d.owner {
+			if email == args[0].Value.(string) {
+				delete(c.d.owner, hash)
+				delete(c.d.expiry, hash)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unexpected statement %q", query)
+	}
+	return driver.RowsAffected(1), nil
+}
+
+type resetRows struct{ values [][]driver.Value }
+
+func (r *resetRows) Columns() []string { return []string{"user_email", "expires_at"} }
+func (r *resetRows) Close() error      { return nil }
+func (r *resetRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
+
+var fakeResetDB = &resetDB{}
+
+func init() {
+	sql.Register("resetdb", fakeResetDB)
+}
+
+func TestResetPassword(t *testing.T) {
+	defer func(p db.ConnectionPool, s SessionStore) { db.Pool, Store = p, s }(db.Pool, Store)
+	pool, err := sql.Open("resetdb", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+	db.Pool = db.ConnectionPool{DB: pool}
+	Store = NewMemoryStore()
+	fakeResetDB.owner = map[string]string{}
+	fakeResetDB.expiry = map[string]time.Time{}
+	fakeResetDB.passwords = map[string][]byte{}
+
+	addReset := func(email string, expires time.Time) string {
+		token, hash, err := newResetToken()
+		if err != nil {
+			t.Fatal(err)
+		}
+		fakeResetDB.mu.Lock()
+		defer fakeResetDB.mu.Unlock()
+		fakeResetDB.owner[string(hash)] = email
+		fakeResetDB.expiry[string(hash)] = expires
+		return token
+	}
+
+	ctx := context.Background()
+	later := time.Now().UTC().Add(time.Hour)
+	expired := addReset("expired@b.c", time.Now().UTC().Add(-time.Second))
+	valid := addReset("valid@b.c", later)
+	sibling := addReset("valid@b.c", later)
+
+	cases := []struct {
+		name  string
+		token string
+		err   error
+	}{
+		{"expired", expired, ErrTokenExpired},
+		{"valid", valid, nil},
+		{"used", valid, ErrBadToken},
+		{"another for the same user", sibling, ErrBadToken},
+		{"malformed", "not a token", ErrBadToken},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := ResetPassword(ctx, tc.token, "new password"); err != tc.err {
+				t.Fatalf("got %v; want %v", err, tc.err)
+			}
+		})
+	}
+
+	if _, ok := fakeResetDB.passwords["expired@b.c"]; ok {
+		t.Error("password was reset with an expired token")
+	}
+	if _, ok := fakeResetDB.passwords["valid@b.c"]; !ok {
+		t.Error("password wasn't reset with a valid token")
+	}
+}
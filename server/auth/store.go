@@ -0,0 +1,154 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/calvinsomething/go-proj/db"
+)
+
+type (
+	// SessionStore persists sessions. Get, Touch and Delete return ErrNoSession for sessions that
+	// don't exist.
+	SessionStore interface {
+		// Create saves a new session and sets its PublicID.
+		Create(ctx context.Context, s *SessionRecord) error
+		Get(ctx context.Context, id string) (*SessionRecord, error)
+		// Touch replaces the key id, data and last use of the session, but only if it was last used at
+		// updatedAt, so that concurrent touches don't overwrite each other.
+		Touch(ctx context.Context, id, keyID string, data []byte, updatedAt, now time.Time) error
+		Delete(ctx context.Context, id string) error
+		// DeleteByUser deletes all of the User's sessions.
+		DeleteByUser(ctx context.Context, email string) error
+		// List returns all of the User's sessions, expired or not.
+		List(ctx context.Context, email string) ([]*SessionRecord, error)
+		// DeleteExpired deletes sessions last used before idleBefore or created before createdBefore,
+		// returning how many were deleted.
+		DeleteExpired(ctx context.Context, idleBefore, createdBefore time.Time) (int64, error)
+	}
+
+	// SessionRecord is a session as it is stored. ID is the secret session id, and Data is the
+	// encoded User followed by its MAC, made with the key with KeyID.
+	SessionRecord struct {
+		ID        string
+		PublicID  int64
+		Email     string
+		KeyID     string
+		Data      []byte
+		UserAgent string
+		IP        string
+		CreatedAt time.Time
+		UpdatedAt time.Time
+	}
+
+	// SQLStore stores sessions in the sessions table of db.Pool.
+	SQLStore struct{}
+)
+
+// Store is where sessions are kept.
+var Store SessionStore = SQLStore{}
+
+const sessionColumns = "id, public_id, user_email, key_id, data, user_agent, ip, created_at, updated_at"
+
+func scanSession(row interface{ Scan(...interface{}) error }) (*SessionRecord, error) {
+	var s SessionRecord
+	err := row.Scan(&s.ID, &s.PublicID, &s.Email, &s.KeyID, &s.Data, &s.UserAgent, &s.IP, &s.CreatedAt, &s.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrNoSession
+	} else if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// Create implements SessionStore.
+func (SQLStore) Create(ctx context.Context, s *SessionRecord) error {
+	res, err := db.Pool.ExecContext(ctx, `
+		INSERT INTO sessions (id, user_email, key_id, data, user_agent, ip, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?);
+	`, s.ID, s.Email, s.KeyID, s.Data, s.UserAgent, s.IP, s.CreatedAt, s.UpdatedAt)
+	if err != nil {
+		return err
+	}
+	s.PublicID, err = res.LastInsertId()
+	return err
+}
+
+// Get implements SessionStore.
+func (SQLStore) Get(ctx context.Context, id string) (*SessionRecord, error) {
+	return scanSession(db.Pool.QueryRowContext(ctx, `
+		SELECT `+sessionColumns+`
+		FROM sessions
+		WHERE id = ?;
+	`, id))
+}
+
+// Touch implements SessionStore.
+func (SQLStore) Touch(ctx context.Context, id, keyID string, data []byte, updatedAt, now time.Time) error {
+	err := db.Pool.MustAffect(ctx, `
+		UPDATE sessions
+		SET key_id = ?, data = ?, updated_at = ?
+		WHERE id = ? AND updated_at = ?;
+	`, keyID, data, now, id, updatedAt)
+	if err == db.ErrNoEffect {
+		return ErrNoSession
+	}
+	return err
+}
+
+// Delete implements SessionStore.
+func (SQLStore) Delete(ctx context.Context, id string) error {
+	err := db.Pool.MustAffect(ctx, `
+		DELETE FROM sessions
+		WHERE id = ?;
+	`, id)
+	if err == db.ErrNoEffect {
+		return ErrNoSession
+	}
+	return err
+}
+
+// DeleteByUser implements SessionStore.
+func (SQLStore) DeleteByUser(ctx context.Context, email string) error {
+	_, err := db.Pool.ExecContext(ctx, `
+		DELETE FROM sessions
+		WHERE user_email = ?;
+	`, email)
+	return err
+}
+
+// List implements SessionStore.
+func (SQLStore) List(ctx context.Context, email string) ([]*SessionRecord, error) {
+	rows, err := db.Pool.QueryContext(ctx, `
+		SELECT `+sessionColumns+`
+		FROM sessions
+		WHERE user_email = ?;
+	`, email)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sessions []*SessionRecord
+	for rows.Next() {
+		s, err := scanSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, s)
+	}
+	return sessions, rows.Err()
+}
+
+// DeleteExpired implements SessionStore.
+func (SQLStore) DeleteExpired(ctx context.Context, idleBefore, createdBefore time.Time) (int64, error) {
+	res, err := db.Pool.ExecContext(ctx, `
+		DELETE FROM sessions
+		WHERE updated_at < ? OR created_at < ?;
+	`, idleBefore, createdBefore)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
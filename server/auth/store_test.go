@@ -0,0 +1,100 @@
+package auth
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestSessionStores(t *testing.T) {
+	path := t.TempDir() + "/sessions.gob"
+	fileStore, err := OpenFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stores := map[string]func() SessionStore{
+		"memory": func() SessionStore { return NewMemoryStore() },
+		"file":   func() SessionStore { return fileStore },
+	}
+
+	ctx := context.Background()
+	now := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			s := store()
+			a := &SessionRecord{ID: "a", Email: "a@b.c", Data: []byte("a"), CreatedAt: now, UpdatedAt: now}
+			b := &SessionRecord{ID: "b", Email: "a@b.c", Data: []byte("b"), CreatedAt: now, UpdatedAt: now}
+			for _, r := range []*SessionRecord{a, b} {
+				if err := s.Create(ctx, r); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if a.PublicID == 0 || a.PublicID == b.PublicID {
+				t.Fatalf("got public ids %d and %d; want distinct ids", a.PublicID, b.PublicID)
+			}
+
+			later := now.Add(time.Hour)
+			if err := s.Touch(ctx, "a", "k", []byte("a2"), now, later); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Touch(ctx, "a", "k", []byte("a3"), now, later); err != ErrNoSession {
+				t.Fatalf("got %v touching with a stale time; want %v", err, ErrNoSession)
+			}
+			got, err := s.Get(ctx, "a")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.KeyID != "k" || string(got.Data) != "a2" || !got.UpdatedAt.Equal(later) {
+				t.Fatalf("got %q signed by %q updated at %s; want %q signed by %q updated at %s",
+					got.Data, got.KeyID, got.UpdatedAt, "a2", "k", later)
+			}
+
+			if n, err := s.DeleteExpired(ctx, now.Add(time.Minute), now); err != nil || n != 1 {
+				t.Fatalf("got %d deleted, %v; want 1 deleted", n, err)
+			}
+			if _, err := s.Get(ctx, "b"); err != ErrNoSession {
+				t.Fatalf("got %v getting an expired session; want %v", err, ErrNoSession)
+			}
+
+			list, err := s.List(ctx, "a@b.c")
+			if err != nil || len(list) != 1 || list[0].ID != "a" {
+				t.Fatalf("got %v, %v listing sessions; want only session a", list, err)
+			}
+			if err := s.Delete(ctx, "a"); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Delete(ctx, "a"); err != ErrNoSession {
+				t.Fatalf("got %v deleting twice; want %v", err, ErrNoSession)
+			}
+
+			d := &SessionRecord{ID: "d", Email: "d@e.f", CreatedAt: now, UpdatedAt: now}
+			for _, r := range []*SessionRecord{a, b, d} {
+				if err := s.Create(ctx, r); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := s.DeleteByUser(ctx, "a@b.c"); err != nil {
+				t.Fatal(err)
+			}
+			if list, err := s.List(ctx, "a@b.c"); err != nil || len(list) != 0 {
+				t.Fatalf("got %v, %v listing sessions deleted by user; want none", list, err)
+			}
+			if _, err := s.Get(ctx, "d"); err != nil {
+				t.Fatalf("got %v getting another user's session; want it kept", err)
+			}
+		})
+	}
+
+	// the file store's sessions survive reopening it
+	if err = fileStore.Create(ctx, &SessionRecord{ID: "c", Email: "a@b.c", CreatedAt: now, UpdatedAt: now}); err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := OpenFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = reopened.Get(ctx, "c"); err != nil {
+		t.Fatalf("got %v getting a session after reopening; want it found", err)
+	}
+}
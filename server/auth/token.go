@@ -0,0 +1,61 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrBadToken ...
+	ErrBadToken = errors.New("Invalid token")
+	// ErrTokenExpired ...
+	ErrTokenExpired = errors.New("Token expired")
+)
+
+// signToken returns a token for the subject that expires at expires, signed with the signing key.
+// The purpose is signed too, so that tokens for one purpose can't be used for another.
+func signToken(purpose, subject string, expires time.Time) string {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(subject)) + "." + strconv.FormatInt(expires.Unix(), 10) +
+		"." + signingKey.ID
+	mac := getHMAC(signingKey.Secret, []byte(purpose+"."+payload))
+	return payload + "." + base64.RawURLEncoding.EncodeToString(mac)
+}
+
+// verifyToken returns the subject of a token made by signToken for the purpose.
+func verifyToken(purpose, token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 4 {
+		return "", ErrBadToken
+	}
+
+	key, ok := verifyingKeys[parts[2]]
+	if !ok {
+		return "", ErrBadToken
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(parts[3])
+	if err != nil {
+		return "", ErrBadToken
+	}
+	payload := strings.Join(parts[:3], ".")
+	if !hmac.Equal(getHMAC(key, []byte(purpose+"."+payload)), mac) {
+		return "", ErrBadToken
+	}
+
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return "", ErrBadToken
+	}
+	if time.Now().After(time.Unix(expires, 0)) {
+		return "", ErrTokenExpired
+	}
+
+	subject, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", ErrBadToken
+	}
+	return string(subject), nil
+}
@@ -0,0 +1,57 @@
+package auth
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerifyToken(t *testing.T) {
+	old := Key{ID: "old", Secret: bytes.Repeat([]byte{1}, 32)}
+	current := Key{ID: "current", Secret: bytes.Repeat([]byte{2}, 32)}
+	gone := Key{ID: "gone", Secret: bytes.Repeat([]byte{3}, 32)}
+
+	sign := func(key Key, purpose string, expires time.Time) string {
+		if err := SetKeys(key); err != nil {
+			t.Fatal(err)
+		}
+		return signToken(purpose, "a@b.c", expires)
+	}
+	later := time.Now().Add(time.Hour)
+	valid := sign(current, "verify", later)
+	rotated := sign(old, "verify", later)
+	unknown := sign(gone, "verify", later)
+	expired := sign(current, "verify", time.Now().Add(-time.Second))
+	parts := strings.Split(valid, ".")
+
+	cases := []struct {
+		name    string
+		purpose string
+		token   string
+		err     error
+	}{
+		{"valid", "verify", valid, nil},
+		{"previous key", "verify", rotated, nil},
+		{"unknown key", "verify", unknown, ErrBadToken},
+		{"expired", "verify", expired, ErrTokenExpired},
+		{"other purpose", "reset", valid, ErrBadToken},
+		{"other subject", "verify", "eEBiLmM." + strings.Join(parts[1:], "."), ErrBadToken},
+		{"later expiry", "verify", strings.Join([]string{parts[0], "9999999999", parts[2], parts[3]}, "."), ErrBadToken},
+		{"bad mac encoding", "verify", strings.Join(append(parts[:3:3], "!"), "."), ErrBadToken},
+		{"missing part", "verify", strings.Join(parts[:3], "."), ErrBadToken},
+		{"empty", "verify", "", ErrBadToken},
+	}
+
+	if err := SetKeys(current, old); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			subject, err := verifyToken(tc.purpose, tc.token)
+			if err != tc.err || (err == nil && subject != "a@b.c") {
+				t.Fatalf("got %q, %v; want %q, %v", subject, err, "a@b.c", tc.err)
+			}
+		})
+	}
+}
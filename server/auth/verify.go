@@ -0,0 +1,104 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/calvinsomething/go-proj/db"
+)
+
+const verifyPurpose = "verify"
+
+var (
+	// VerificationTTL is how long a verification token is valid.
+	VerificationTTL = time.Hour * 24
+	// VerificationResendInterval is the least time between sending verification tokens to a User.
+	VerificationResendInterval = time.Minute
+
+	// ErrUnverified ...
+	ErrUnverified = errors.New("Email address not verified")
+	// ErrVerified ...
+	ErrVerified = errors.New("Email address already verified")
+	// ErrNoUser ...
+	ErrNoUser = errors.New("User not found")
+)
+
+// ThrottledError is returned when something is asked for again too soon.
+type ThrottledError struct {
+	RetryAfter time.Duration
+}
+
+func (e *ThrottledError) Error() string {
+	return "Try again in " + e.RetryAfter.Round(time.Second).String()
+}
+
+// VerificationToken returns a token to send to the User's email address to verify it, which
+// Verify accepts. It returns ErrNoUser or ErrVerified if there is nothing to verify, and a
+// *ThrottledError if a token was made less than VerificationResendInterval ago.
+func VerificationToken(ctx context.Context, email string) (string, error) {
+	now := time.Now().UTC().Truncate(time.Second)
+
+	err := db.Pool.InTx(ctx, func(tx *sql.Tx) error {
+		var verifiedAt, sentAt *time.Time
+		err := tx.QueryRowContext(ctx, `
+			SELECT verified_at, verification_sent_at
+			FROM users
+			WHERE email = ?
+			FOR UPDATE;
+		`, email).Scan(&verifiedAt, &sentAt)
+		if err == sql.ErrNoRows {
+			return ErrNoUser
+		} else if err != nil {
+			return err
+		}
+
+		if verifiedAt != nil {
+			return ErrVerified
+		}
+		if sentAt != nil {
+			if wait := sentAt.Add(VerificationResendInterval).Sub(now); wait > 0 {
+				return &ThrottledError{RetryAfter: wait}
+			}
+		}
+
+		_, err = tx.ExecContext(ctx, `
+			UPDATE users
+			SET verification_sent_at = ?
+			WHERE email = ?;
+		`, now, email)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return signToken(verifyPurpose, email, now.Add(VerificationTTL)), nil
+}
+
+// Verify marks the email address in a token from VerificationToken as verified. Verifying an
+// address again succeeds.
+func Verify(ctx context.Context, token string) error {
+	email, err := verifyToken(verifyPurpose, token)
+	if err != nil {
+		return err
+	}
+
+	err = db.Pool.MustAffect(ctx, `
+		UPDATE users
+		SET verified_at = ?
+		WHERE email = ? AND verified_at IS NULL;
+	`, time.Now().UTC(), email)
+	if err == db.ErrNoEffect {
+		var exists bool
+		err = db.Pool.QueryRowContext(ctx, `
+			SELECT EXISTS (SELECT 1 FROM users WHERE email = ?);
+		`, email).Scan(&exists)
+		if err == nil && !exists {
+			// the user was deleted since the token was made
+			return ErrNoUser
+		}
+	}
+	return err
+}
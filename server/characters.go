@@ -0,0 +1,197 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/calvinsomething/go-proj/models"
+)
+
+// characterRoutes registers the routes for the logged in user's characters on the "/me" group.
+func characterRoutes(me *mux) {
+	me.get("/characters", getCharactersHandler)
+	me.post("/characters", addCharacterHandler)
+	me.get("/characters/{id}", getCharacterHandler)
+	me.put("/characters/{id}", replaceCharacterHandler)
+	me.delete("/characters/{id}", deleteCharacterHandler)
+	me.put("/characters/{id}/main", setMainCharacterHandler)
+}
+
+// respondCharacter writes the character with its ETag.
+func respondCharacter(w http.ResponseWriter, r *http.Request, statusCode int, c *models.Character) {
+	w.Header().Set("ETag", etag(c.Version))
+	respond(w, r, statusCode, c)
+}
+
+func getCharactersHandler(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+
+	characters, err := models.GetCharacters(r.Context(), user.Email)
+	if err != nil {
+		modelErr(w, r, err, "character")
+		return
+	}
+	respond(w, r, http.StatusOK, characters)
+}
+
+func getCharacterHandler(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+
+	id, ok := pathID(r)
+	if !ok {
+		modelErr(w, r, models.ErrNotFound, "character")
+		return
+	}
+
+	c, err := models.GetCharacter(r.Context(), user.Email, id)
+	if err != nil {
+		modelErr(w, r, err, "character")
+		return
+	}
+	respondCharacter(w, r, http.StatusOK, c)
+}
+
+func addCharacterHandler(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+
+	var c models.Character
+	if err := decodeBody(r, &c); err != nil {
+		decodeErr(w, r, err)
+		return
+	}
+
+	if err := validate.Struct(&c); err != nil {
+		validationErr(w, r, err)
+		return
+	}
+
+	c.Owner = user.Email
+	ctx := r.Context()
+
+	if err := c.Create(ctx); err != nil {
+		modelErr(w, r, err, "character")
+		return
+	}
+
+	saved, err := models.GetCharacter(ctx, user.Email, c.ID)
+	if err != nil {
+		modelErr(w, r, err, "character")
+		return
+	}
+
+	w.Header().Set("Location", requestPath(r)+"/"+strconv.FormatInt(c.ID, 10))
+	respondCharacter(w, r, http.StatusCreated, saved)
+}
+
+// replaceCharacterHandler replaces a character, optionally only if it matches If-Match. Whether
+// it is the main is changed with setMainCharacterHandler instead.
+func replaceCharacterHandler(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+
+	match, ok := ifMatch(r)
+	if !ok {
+		httpErr(w, r, http.StatusPreconditionFailed, nil, "invalid If-Match header")
+		return
+	}
+
+	id, ok := pathID(r)
+	if !ok {
+		modelErr(w, r, models.ErrNotFound, "character")
+		return
+	}
+
+	var c models.Character
+	if err := decodeBody(r, &c); err != nil {
+		decodeErr(w, r, err)
+		return
+	}
+
+	if err := validate.Struct(&c); err != nil {
+		validationErr(w, r, err)
+		return
+	}
+
+	ctx := r.Context()
+	existing, err := models.GetCharacter(ctx, user.Email, id)
+	if err != nil {
+		modelErr(w, r, err, "character")
+		return
+	}
+	version, ok := matchVersion(w, r, match, existing.Version, "character")
+	if !ok {
+		return
+	}
+
+	c.ID = id
+	c.Owner = user.Email
+	if err := c.Update(ctx, version); err != nil {
+		modelErr(w, r, err, "character")
+		return
+	}
+
+	saved, err := models.GetCharacter(ctx, user.Email, id)
+	if err != nil {
+		modelErr(w, r, err, "character")
+		return
+	}
+	respondCharacter(w, r, http.StatusOK, saved)
+}
+
+func deleteCharacterHandler(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+
+	match, ok := ifMatch(r)
+	if !ok {
+		httpErr(w, r, http.StatusPreconditionFailed, nil, "invalid If-Match header")
+		return
+	}
+
+	id, ok := pathID(r)
+	if !ok {
+		modelErr(w, r, models.ErrNotFound, "character")
+		return
+	}
+
+	ctx := r.Context()
+	existing, err := models.GetCharacter(ctx, user.Email, id)
+	if err != nil {
+		modelErr(w, r, err, "character")
+		return
+	}
+	version, ok := matchVersion(w, r, match, existing.Version, "character")
+	if !ok {
+		return
+	}
+
+	if err := models.DeleteCharacter(ctx, user.Email, id, version); err != nil {
+		modelErr(w, r, err, "character")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// setMainCharacterHandler makes the character the user's main and responds with all of their
+// characters, since the previous main has changed too.
+func setMainCharacterHandler(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+
+	id, ok := pathID(r)
+	if !ok {
+		modelErr(w, r, models.ErrNotFound, "character")
+		return
+	}
+
+	ctx := r.Context()
+	if err := models.SetMainCharacter(ctx, user.Email, id); err != nil {
+		modelErr(w, r, err, "character")
+		return
+	}
+
+	characters, err := models.GetCharacters(ctx, user.Email)
+	if err != nil {
+		modelErr(w, r, err, "character")
+		return
+	}
+	respond(w, r, http.StatusOK, characters)
+}
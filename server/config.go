@@ -0,0 +1,84 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// envString returns the environment variable, or def if it is unset or empty.
+func envString(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+// envList splits a comma separated environment variable, or returns def if it is unset or empty.
+func envList(key string, def ...string) []string {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+
+	var list []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func envBool(key string, def bool) bool {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Fatalf("Invalid boolean for %s: %q", key, v)
+	}
+	return b
+}
+
+func envInt(key string, def int) int {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		log.Fatalf("Invalid integer for %s: %q", key, v)
+	}
+	return i
+}
+
+// envUint parses a positive integer no larger than max, or returns def if the variable is unset or
+// empty.
+func envUint(key string, def, max uint64) uint64 {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	i, err := strconv.ParseUint(v, 10, 64)
+	if err != nil || i == 0 || i > max {
+		log.Fatalf("Invalid integer for %s: %q, it must be between 1 and %d", key, v, max)
+	}
+	return i
+}
+
+// envDuration parses a duration like "30s", or returns def if the variable is unset or empty.
+func envDuration(key string, def time.Duration) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Fatalf("Invalid duration for %s: %q", key, v)
+	}
+	return d
+}
@@ -9,7 +9,7 @@ import (
 	"os"
 	"time"
 
-	_ "github.com/go-sql-driver/mysql" // driver for db
+	driver "github.com/go-sql-driver/mysql"
 	"github.com/golang-migrate/migrate/v4"
 	"github.com/golang-migrate/migrate/v4/database/mysql"
 	_ "github.com/golang-migrate/migrate/v4/source/file" // required for migration files to be used
@@ -40,7 +40,7 @@ func (l Logger) Verbose() bool {
 // Initialize connects the database and pings to confirm.
 func Initialize(USER, PASSWORD, PORT, NAME string) {
 	var err error
-	pool, err := sql.Open("mysql", fmt.Sprintf("%s:%s@tcp(db:%s)/%s?multiStatements=true",
+	pool, err := sql.Open("mysql", fmt.Sprintf("%s:%s@tcp(db:%s)/%s?multiStatements=true&parseTime=true",
 		USER,
 		PASSWORD,
 		PORT,
@@ -131,3 +131,25 @@ func (p *ConnectionPool) MustAffect(ctx context.Context, stmt string, args ...in
 	}
 	return nil
 }
+
+// IsDuplicate reports whether err is caused by a duplicate entry for a unique key.
+func IsDuplicate(err error) bool {
+	var mysqlErr *driver.MySQLError
+	return errors.As(err, &mysqlErr) && mysqlErr.Number == 1062
+}
+
+// InTx runs fn in a transaction, which is committed if fn returns nil and rolled back otherwise.
+func (p *ConnectionPool) InTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := p.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	if err = fn(tx); err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			log.Println("UNHANDLED:", rbErr)
+		}
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,6 @@
+ALTER TABLE users
+    ADD COLUMN verified_at DATETIME NULL,
+    ADD COLUMN verification_sent_at DATETIME NULL;
+
+-- users from before verification was required are trusted
+UPDATE users SET verified_at = UTC_TIMESTAMP();
\ No newline at end of file
@@ -0,0 +1,7 @@
+CREATE TABLE password_resets (
+    token_hash BINARY(32) NOT NULL PRIMARY KEY,
+    user_email VARCHAR(255) NOT NULL,
+    created_at DATETIME NOT NULL,
+    expires_at DATETIME NOT NULL,
+    CONSTRAINT fk_password_resets_user FOREIGN KEY (user_email) REFERENCES users (email) ON DELETE CASCADE
+);
\ No newline at end of file
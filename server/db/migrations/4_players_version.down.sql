@@ -0,0 +1 @@
+ALTER TABLE players DROP COLUMN version;
\ No newline at end of file
@@ -0,0 +1,13 @@
+-- only one player per address was allowed before, so each address keeps its latest player
+DELETE older
+FROM players older
+JOIN players newer ON newer.last_ip = older.last_ip AND newer.id > older.id;
+
+ALTER TABLE players
+    DROP FOREIGN KEY fk_players_user,
+    DROP INDEX user_email,
+    DROP COLUMN created_ip,
+    DROP COLUMN user_email,
+    DROP COLUMN id,
+    RENAME COLUMN last_ip TO ip,
+    ADD UNIQUE (ip);
\ No newline at end of file
@@ -0,0 +1,10 @@
+ALTER TABLE players
+    DROP INDEX ip,
+    RENAME COLUMN ip TO last_ip,
+    ADD COLUMN id BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY FIRST,
+    ADD COLUMN user_email VARCHAR(255) AFTER id,
+    ADD COLUMN created_ip VARCHAR(51) AFTER user_email,
+    ADD UNIQUE (user_email),
+    ADD CONSTRAINT fk_players_user FOREIGN KEY (user_email) REFERENCES users (email) ON DELETE CASCADE;
+
+UPDATE players SET created_ip = last_ip;
\ No newline at end of file
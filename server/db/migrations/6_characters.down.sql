@@ -0,0 +1 @@
+DROP TABLE characters;
\ No newline at end of file
@@ -0,0 +1,21 @@
+CREATE TABLE characters (
+    id BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    user_email VARCHAR(255) NOT NULL,
+    name VARCHAR(12) NOT NULL,
+    realm VARCHAR(50) NOT NULL,
+    level TINYINT UNSIGNED NOT NULL CHECK (level BETWEEN 1 AND 60),
+    race ENUM('dwarf', 'gnome', 'human', 'night elf', 'orc', 'tauren', 'troll', 'undead') NOT NULL,
+    class ENUM('druid', 'hunter', 'mage', 'paladin', 'priest', 'rogue', 'shaman', 'warlock', 'warrior') NOT NULL,
+    faction ENUM('H', 'A') AS (IF(race IN ('dwarf', 'gnome', 'human', 'night elf'), 'A', 'H')) STORED,
+    profession1 ENUM('alchemy', 'blacksmithing', 'enchanting', 'engineering', 'herbalism', 'mining', 'tailoring'),
+    profession2 ENUM('alchemy', 'blacksmithing', 'enchanting', 'engineering', 'herbalism', 'mining', 'tailoring'),
+    is_main BOOLEAN NOT NULL DEFAULT FALSE,
+    -- set to user_email on the main character only, so that a user can't have more than one. It is
+    -- written by the model since MySQL doesn't allow generating it from a column with ON DELETE CASCADE
+    main_of VARCHAR(255),
+    version INT NOT NULL DEFAULT 1,
+    UNIQUE (name, realm),
+    UNIQUE (main_of),
+    CHECK (profession2 != profession1),
+    FOREIGN KEY (user_email) REFERENCES users (email) ON DELETE CASCADE
+);
\ No newline at end of file
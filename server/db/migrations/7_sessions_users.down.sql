@@ -0,0 +1,6 @@
+ALTER TABLE sessions
+    DROP FOREIGN KEY fk_sessions_user,
+    DROP COLUMN ip,
+    DROP COLUMN user_agent,
+    DROP COLUMN user_email,
+    DROP COLUMN public_id;
\ No newline at end of file
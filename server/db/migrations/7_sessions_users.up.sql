@@ -0,0 +1,9 @@
+-- sessions from before they were linked to users can't be listed or revoked, so they are dropped
+DELETE FROM sessions;
+
+ALTER TABLE sessions
+    ADD COLUMN public_id BIGINT NOT NULL AUTO_INCREMENT UNIQUE AFTER id,
+    ADD COLUMN user_email VARCHAR(255) NOT NULL AFTER public_id,
+    ADD COLUMN user_agent VARCHAR(255) NOT NULL DEFAULT '' AFTER data,
+    ADD COLUMN ip VARCHAR(51) NOT NULL DEFAULT '' AFTER user_agent,
+    ADD CONSTRAINT fk_sessions_user FOREIGN KEY (user_email) REFERENCES users (email) ON DELETE CASCADE;
\ No newline at end of file
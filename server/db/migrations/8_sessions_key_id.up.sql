@@ -0,0 +1,2 @@
+ALTER TABLE sessions
+    ADD COLUMN key_id VARCHAR(64) NOT NULL DEFAULT '' AFTER user_email;
\ No newline at end of file
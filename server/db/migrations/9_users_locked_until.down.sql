@@ -0,0 +1,2 @@
+ALTER TABLE users
+    DROP COLUMN locked_until;
\ No newline at end of file
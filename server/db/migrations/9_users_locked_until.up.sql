@@ -0,0 +1,2 @@
+ALTER TABLE users
+    ADD COLUMN locked_until DATETIME NULL AFTER failed_attempts;
\ No newline at end of file
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// maxBodySize is the largest request body that decodeBody will read.
+const maxBodySize = 1 << 20
+
+// bodyError is returned by decodeBody with the status code the request should fail with.
+type bodyError struct {
+	status int
+	err    error
+}
+
+func (e *bodyError) Error() string {
+	return e.err.Error()
+}
+
+// decodeBody decodes the request body into the struct pointed to by dst. JSON, url encoded forms
+// and multipart forms are accepted based on the Content-Type, which defaults to JSON. Form fields
+// are matched to struct fields by their json tag. Unknown fields are rejected.
+func decodeBody(r *http.Request, dst interface{}) error {
+	defer r.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxBodySize+1))
+	if err != nil {
+		return &bodyError{http.StatusBadRequest, err}
+	} else if len(body) > maxBodySize {
+		return &bodyError{http.StatusRequestEntityTooLarge, fmt.Errorf("request body is larger than %d bytes", maxBodySize)}
+	}
+
+	contentType := r.Header.Get("Content-Type")
+	mediaType := "application/json"
+	if contentType != "" {
+		if mediaType, _, err = mime.ParseMediaType(contentType); err != nil {
+			return &bodyError{http.StatusUnsupportedMediaType, err}
+		}
+	}
+
+	switch mediaType {
+	case "application/json", "application/merge-patch+json":
+		err = decodeJSON(body, dst)
+	case "application/x-www-form-urlencoded", "multipart/form-data":
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		if mediaType == "multipart/form-data" {
+			err = r.ParseMultipartForm(maxBodySize)
+		} else {
+			err = r.ParseForm()
+		}
+		if err == nil {
+			err = decodeForm(r.PostForm, dst)
+		}
+	default:
+		return &bodyError{http.StatusUnsupportedMediaType, fmt.Errorf("unsupported Content-Type %q", mediaType)}
+	}
+
+	if err != nil {
+		return &bodyError{http.StatusBadRequest, err}
+	}
+	return nil
+}
+
+func decodeJSON(body []byte, dst interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(dst); err != nil {
+		return err
+	}
+	if decoder.More() {
+		return errors.New("request body must contain a single JSON value")
+	}
+	return nil
+}
+
+// decodeForm sets the fields of the struct pointed to by dst from the form values.
+func decodeForm(form url.Values, dst interface{}) error {
+	v := reflect.ValueOf(dst)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("cannot decode form into %T", dst)
+	}
+	v = v.Elem()
+
+	fields := map[string]reflect.Value{}
+	for i := 0; i < v.NumField(); i++ {
+		if f := v.Type().Field(i); f.IsExported() {
+			if name := jsonFieldName(f); name != "" {
+				fields[name] = v.Field(i)
+			}
+		}
+	}
+
+	for name, values := range form {
+		field, ok := fields[name]
+		if !ok {
+			return fmt.Errorf("unknown field %q", name)
+		}
+		if err := setField(field, values); err != nil {
+			return fmt.Errorf("invalid value for field %q: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// setField parses the form values into the field. Empty values leave pointer fields nil.
+func setField(field reflect.Value, values []string) error {
+	switch field.Kind() {
+	case reflect.Ptr:
+		if len(values) == 1 && values[0] == "" {
+			return nil
+		}
+		ptr := reflect.New(field.Type().Elem())
+		if err := setField(ptr.Elem(), values); err != nil {
+			return err
+		}
+		field.Set(ptr)
+		return nil
+	case reflect.Slice:
+		slice := reflect.MakeSlice(field.Type(), len(values), len(values))
+		for i, value := range values {
+			if err := setField(slice.Index(i), []string{value}); err != nil {
+				return err
+			}
+		}
+		field.Set(slice)
+		return nil
+	}
+
+	if len(values) != 1 {
+		return errors.New("expected a single value")
+	}
+	value := values[0]
+
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(strings.TrimSpace(value), 10, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		u, err := strconv.ParseUint(strings.TrimSpace(value), 10, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetUint(u)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(strings.TrimSpace(value), field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetFloat(f)
+	default:
+		return fmt.Errorf("unsupported field type %s", field.Type())
+	}
+	return nil
+}
+
+// mergePatch applies an RFC 7396 JSON Merge Patch to the decoded JSON target.
+func mergePatch(target, patch interface{}) interface{} {
+	patchObj, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+
+	targetObj, ok := target.(map[string]interface{})
+	if !ok {
+		targetObj = map[string]interface{}{}
+	}
+	for k, v := range patchObj {
+		if v == nil {
+			delete(targetObj, k)
+		} else {
+			targetObj[k] = mergePatch(targetObj[k], v)
+		}
+	}
+	return targetObj
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+type (
+	// encoder writes data into the buffer in a single media type.
+	encoder func(buf *bytes.Buffer, data interface{}) error
+
+	format struct {
+		mediaType   string
+		aliases     []string
+		contentType string
+		encode      encoder
+	}
+)
+
+// errNotEncodable is returned by an encoder that cannot represent the data.
+var errNotEncodable = errors.New("data cannot be encoded in this format")
+
+// formats are the supported response media types in order of preference, the first is the
+// default.
+var formats = []format{
+	{"application/json", nil, "application/json", encodeJSON},
+	{"text/csv", nil, "text/csv; charset=utf-8", encodeCSV},
+	{"application/msgpack", []string{"application/x-msgpack", "application/vnd.msgpack"}, "application/msgpack", encodeMsgpack},
+}
+
+// respond writes data in the format preferred by the request's Accept header, or responds with
+// 406 if none of the acceptable formats can represent the data.
+func respond(w http.ResponseWriter, r *http.Request, statusCode int, data interface{}) {
+	w.Header().Add("Vary", "Accept")
+
+	var buf bytes.Buffer
+	for _, mediaType := range acceptedMediaTypes(r) {
+		for _, f := range formats {
+			if !f.matches(mediaType) {
+				continue
+			}
+
+			buf.Reset()
+			if err := f.encode(&buf, data); err == errNotEncodable {
+				continue
+			} else if err != nil {
+				httpErr(w, r, 500, err)
+				return
+			}
+
+			w.Header().Set("Content-Type", f.contentType)
+			w.WriteHeader(statusCode)
+			w.Write(buf.Bytes())
+			return
+		}
+	}
+
+	httpErr(w, r, http.StatusNotAcceptable, nil, "supported types are application/json, text/csv and application/msgpack")
+}
+
+// matches reports whether the format is acceptable for the media range. Structured syntax types
+// like "application/vnd.goproj.v2+json" are served as JSON.
+func (f format) matches(mediaRange string) bool {
+	switch {
+	case mediaRange == "*/*":
+		return true
+	case strings.HasSuffix(mediaRange, "/*"):
+		return strings.HasPrefix(f.mediaType, strings.TrimSuffix(mediaRange, "*"))
+	case strings.HasSuffix(mediaRange, "+json"):
+		return f.mediaType == "application/json"
+	case mediaRange == f.mediaType:
+		return true
+	}
+	for _, alias := range f.aliases {
+		if mediaRange == alias {
+			return true
+		}
+	}
+	return false
+}
+
+func encodeJSON(buf *bytes.Buffer, data interface{}) error {
+	return json.NewEncoder(buf).Encode(data)
+}
+
+func encodeMsgpack(buf *bytes.Buffer, data interface{}) error {
+	enc := msgpack.NewEncoder(buf)
+	enc.SetCustomStructTag("json")
+	return enc.Encode(data)
+}
+
+// encodeCSV writes a struct or a slice of structs as CSV, with a header row of the json field
+// names. Nil pointers are written as empty cells.
+func encodeCSV(buf *bytes.Buffer, data interface{}) error {
+	v := reflect.Indirect(reflect.ValueOf(data))
+	rows := []reflect.Value{v}
+	elemType := v.Type()
+	if v.Kind() == reflect.Slice || v.Kind() == reflect.Array {
+		rows = make([]reflect.Value, v.Len())
+		for i := range rows {
+			rows[i] = v.Index(i)
+		}
+		elemType = v.Type().Elem()
+	}
+	if elemType.Kind() == reflect.Ptr {
+		elemType = elemType.Elem()
+	}
+	if elemType.Kind() != reflect.Struct {
+		return errNotEncodable
+	}
+
+	var header []string
+	var fields []int
+	for i := 0; i < elemType.NumField(); i++ {
+		if f := elemType.Field(i); f.IsExported() {
+			if name := jsonFieldName(f); name != "" {
+				header = append(header, name)
+				fields = append(fields, i)
+			}
+		}
+	}
+
+	w := csv.NewWriter(buf)
+	if err := w.Write(header); err != nil {
+		return err
+	}
+	for _, row := range rows {
+		row = reflect.Indirect(row)
+		if !row.IsValid() {
+			continue
+		}
+
+		record := make([]string, len(fields))
+		for i, field := range fields {
+			cell, err := csvCell(row.Field(field))
+			if err != nil {
+				return err
+			}
+			record[i] = cell
+		}
+		if err := w.Write(record); err != nil {
+			return err
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
+
+func csvCell(v reflect.Value) (string, error) {
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return "", nil
+		}
+		v = v.Elem()
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		return v.String(), nil
+	case reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return fmt.Sprint(v.Interface()), nil
+	}
+
+	// anything else, like times or nested values, is written as its JSON representation
+	b, err := json.Marshal(v.Interface())
+	if err != nil {
+		return "", err
+	}
+	var s string
+	if json.Unmarshal(b, &s) == nil {
+		return s, nil
+	}
+	return string(b), nil
+}
+
+// acceptedMediaTypes returns the media ranges of the Accept header ordered by preference.
+// Without an Accept header any type is acceptable.
+func acceptedMediaTypes(r *http.Request) []string {
+	type mediaRange struct {
+		mediaType string
+		q         float64
+	}
+
+	var ranges []mediaRange
+	for _, header := range r.Header.Values("Accept") {
+		for _, part := range strings.Split(header, ",") {
+			fields := strings.Split(part, ";")
+			mr := mediaRange{mediaType: strings.ToLower(strings.TrimSpace(fields[0])), q: 1}
+			for _, param := range fields[1:] {
+				if v := strings.TrimSpace(param); strings.HasPrefix(v, "q=") {
+					if q, err := strconv.ParseFloat(v[2:], 64); err == nil {
+						mr.q = q
+					}
+				}
+			}
+			if mr.mediaType != "" && mr.q > 0 {
+				ranges = append(ranges, mr)
+			}
+		}
+	}
+	if len(ranges) == 0 {
+		return []string{"*/*"}
+	}
+	sort.SliceStable(ranges, func(i, j int) bool { return ranges[i].q > ranges[j].q })
+
+	mediaTypes := make([]string, len(ranges))
+	for i, mr := range ranges {
+		mediaTypes[i] = mr.mediaType
+	}
+	return mediaTypes
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/go-playground/validator/v10"
+)
+
+const (
+	problemContentType = "application/problem+json"
+
+	problemValidation = "/problems/validation"
+)
+
+type (
+	// problem is an RFC 7807 problem details response body.
+	problem struct {
+		Type      string       `json:"type"`
+		Title     string       `json:"title"`
+		Status    int          `json:"status"`
+		Detail    string       `json:"detail,omitempty"`
+		Instance  string       `json:"instance,omitempty"`
+		RequestID string       `json:"requestId,omitempty"`
+		Errors    []fieldError `json:"errors,omitempty"`
+	}
+
+	// fieldError describes a single failed validation rule.
+	fieldError struct {
+		Field   string `json:"field"`
+		Rule    string `json:"rule"`
+		Param   string `json:"param,omitempty"`
+		Message string `json:"message"`
+	}
+)
+
+// newProblem creates a problem for the request with the default type for the status code.
+func newProblem(r *http.Request, statusCode int, detail string) *problem {
+	p := &problem{
+		Type:   "about:blank",
+		Title:  http.StatusText(statusCode),
+		Status: statusCode,
+		Detail: detail,
+	}
+	if r != nil {
+		p.Instance = requestPath(r)
+		p.RequestID = requestIDFrom(r.Context())
+	}
+	return p
+}
+
+func writeProblem(w http.ResponseWriter, p *problem) {
+	body, err := json.Marshal(p)
+	if err != nil {
+		log.Output(3, err.Error())
+		w.WriteHeader(p.Status)
+		return
+	}
+
+	w.Header().Set("Content-Type", problemContentType)
+	w.Header().Del("Content-Length")
+	w.WriteHeader(p.Status)
+	w.Write(body)
+}
+
+// httpErr logs err and writes a problem response. The detail is msg if given, otherwise the
+// error message for client errors. Server error messages are never sent to the client.
+func httpErr(w http.ResponseWriter, r *http.Request, statusCode int, err error, msg ...string) {
+	if err != nil {
+		log.Output(2, err.Error())
+	}
+
+	var detail string
+	if len(msg) != 0 {
+		detail = msg[0]
+	} else if err != nil && statusCode < 500 {
+		detail = err.Error()
+	}
+
+	writeProblem(w, newProblem(r, statusCode, detail))
+}
+
+func validationErr(w http.ResponseWriter, r *http.Request, err error) {
+	if _, ok := err.(*validator.InvalidValidationError); ok {
+		log.Output(2, err.Error())
+		writeProblem(w, newProblem(r, 500, "invalid validation error"))
+		return
+	}
+
+	p := newProblem(r, 400, "the request failed validation")
+	p.Type = problemValidation
+	p.Title = "Validation Failed"
+
+	trans := translator(r)
+	w.Header().Set("Content-Language", strings.ReplaceAll(trans.Locale(), "_", "-"))
+	w.Header().Add("Vary", "Accept-Language")
+
+	for _, err := range err.(validator.ValidationErrors) {
+		p.Errors = append(p.Errors, fieldError{
+			Field:   err.Field(),
+			Rule:    err.Tag(),
+			Param:   err.Param(),
+			Message: err.Translate(trans),
+		})
+	}
+	log.Output(2, err.Error())
+	writeProblem(w, p)
+}
+
+// decodeErr writes the problem for an error returned by decodeBody.
+func decodeErr(w http.ResponseWriter, r *http.Request, err error) {
+	status := http.StatusBadRequest
+	if be, ok := err.(*bodyError); ok {
+		status = be.status
+	}
+	log.Output(2, err.Error())
+	writeProblem(w, newProblem(r, status, err.Error()))
+}
+
+// jsonFieldName is used by the validator so that errors are reported with the json field name.
+func jsonFieldName(field reflect.StructField) string {
+	name := strings.SplitN(field.Tag.Get("json"), ",", 2)[0]
+	if name == "-" {
+		return ""
+	}
+	if name == "" {
+		return field.Name
+	}
+	return name
+}
@@ -2,12 +2,16 @@ package main
 
 import (
 	"encoding/json"
-	"io"
+	"errors"
+	"fmt"
+	"log"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/calvinsomething/go-proj/auth"
-	"github.com/calvinsomething/go-proj/db"
 	"github.com/calvinsomething/go-proj/models"
 )
 
@@ -21,126 +25,487 @@ type (
 func loginHandler(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
-		httpErr(w, 400, err)
-		return
-	}
-	defer r.Body.Close()
-
 	var login login
-
-	if err = json.Unmarshal(body, &login); err != nil {
-		httpErr(w, 400, err)
+	if err := decodeBody(r, &login); err != nil {
+		decodeErr(w, r, err)
 		return
 	}
 
-	if err = validate.Struct(&login); err != nil {
-		validationErr(w, err)
+	if err := validate.Struct(&login); err != nil {
+		validationErr(w, r, err)
 		return
 	}
 
-	sid, err := auth.LogIn(ctx, login.Email, login.Password)
+	sid, err := auth.LogIn(ctx, login.Email, login.Password, auth.Client{
+		UserAgent: r.UserAgent(),
+		IP:        clientIP(r),
+	})
+	var locked *auth.LockedError
 	if err == auth.ErrBadLogin {
-		httpErr(w, 400, err)
+		httpErr(w, r, 400, err)
+		return
+	} else if errors.As(err, &locked) {
+		setRetryAfter(w, time.Until(locked.Until))
+		httpErr(w, r, http.StatusLocked, err)
+		return
+	} else if err == auth.ErrUnverified {
+		httpErr(w, r, http.StatusForbidden, err)
 		return
 	} else if err == auth.ErrBadMAC {
-		httpErr(w, 401, err)
+		httpErr(w, r, 401, err)
 		return
 	} else if err != nil {
-		httpErr(w, 500, err)
+		httpErr(w, r, 500, err)
 		return
 	}
 
-	http.SetCookie(w, &http.Cookie{
-		Name:     "session",
-		Value:    sid,
-		MaxAge:   int(auth.SessionMaxAge),
-		HttpOnly: true,
-		SameSite: http.SameSiteStrictMode,
-	})
+	now := time.Now()
+	setSessionCookie(w, r, sid, auth.CookieMaxAge(now, now))
 
 	w.WriteHeader(http.StatusOK)
 }
 
+// setRetryAfter sets the Retry-After header to d, rounded up to whole seconds so that retrying
+// after it isn't too soon.
+func setRetryAfter(w http.ResponseWriter, d time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int((d+time.Second-1)/time.Second)))
+}
+
+// splitValues splits comma separated values, so that they are accepted as well as repeated params.
+func splitValues(query url.Values) url.Values {
+	split := make(url.Values, len(query))
+	for k, values := range query {
+		for _, v := range values {
+			split[k] = append(split[k], strings.Split(v, ",")...)
+		}
+	}
+	return split
+}
+
+// getPlayersHandler responds with a page of players. The total number of matching players is in
+// the X-Total-Count header, and the next page, if any, is linked in the Link header.
 func getPlayersHandler(w http.ResponseWriter, r *http.Request) {
-	rows, err := db.Pool.QueryContext(r.Context(), `SELECT * FROM players`)
+	var q models.PlayerQuery
+	if err := decodeForm(splitValues(r.URL.Query()), &q); err != nil {
+		httpErr(w, r, 400, err)
+		return
+	}
+
+	if err := validate.Struct(&q); err != nil {
+		validationErr(w, r, err)
+		return
+	}
+
+	players, total, next, err := models.GetPlayers(r.Context(), q)
+	if err == models.ErrBadCursor {
+		httpErr(w, r, 400, err)
+		return
+	} else if err != nil {
+		httpErr(w, r, 500, err)
+		return
+	}
+
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+	if next != "" {
+		nextQuery := r.URL.Query()
+		nextQuery.Set("cursor", next)
+		w.Header().Set("Link", fmt.Sprintf(`<%s?%s>; rel="next"`, requestPath(r), nextQuery.Encode()))
+	}
+
+	if players == nil {
+		players = []*models.Player{}
+	}
+	respond(w, r, http.StatusOK, players)
+}
+
+// addPlayerHandler creates or replaces the player belonging to the logged in user.
+func addPlayerHandler(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+
+	var player models.Player
+	if err := decodeBody(r, &player); err != nil {
+		decodeErr(w, r, err)
+		return
+	}
+
+	if err := validate.Struct(&player); err != nil {
+		validationErr(w, r, err)
+		return
+	}
+
+	player.Owner = user.Email
+	player.LastIP = clientIP(r)
+
+	ctx := r.Context()
+
+	if err := player.Save(ctx); err != nil {
+		httpErr(w, r, 500, err, "could not save player data")
+		return
+	}
+
+	savedPlayer, err := models.GetPlayer(ctx, player.ID)
 	if err != nil {
-		httpErr(w, 500, err)
+		httpErr(w, r, 500, err, "could not retrieve saved player")
 		return
 	}
-	defer rows.Close()
 
-	players := make([]models.Player, 0, 5)
+	respondPlayer(w, r, http.StatusCreated, savedPlayer)
+}
+
+// etag returns the entity tag for a version of a resource.
+func etag(version int) string {
+	return `"` + strconv.Itoa(version) + `"`
+}
+
+// entityTags is a parsed If-Match or If-None-Match header.
+type entityTags struct {
+	// present is false without the header, in which case requests are unconditional.
+	present bool
+	// any is true for "*", which matches any current version.
+	any bool
+	// strong and weak are the versions of the strong and weak entity tags in the header.
+	strong, weak []int
+}
+
+// ifMatch parses the If-Match header. ok is false if the header is malformed.
+func ifMatch(r *http.Request) (m entityTags, ok bool) {
+	return parseEntityTags(r, "If-Match")
+}
 
-	for rows.Next() {
-		var p models.Player
-		err := rows.Scan(&p.IP, &p.Faction, &p.Race, &p.Class, &p.Profession1, &p.Profession2, &p.WeeklyHours)
-		if err != nil {
-			httpErr(w, 500, err)
-			return
+// parseEntityTags parses the list of entity tags in the header, as in RFC 9110 section 13.1.1.
+// ok is false if the header is malformed.
+func parseEntityTags(r *http.Request, header string) (m entityTags, ok bool) {
+	values := r.Header.Values(header)
+	if len(values) == 0 {
+		return m, true
+	}
+	m.present = true
+
+	list := strings.TrimSpace(strings.Join(values, ","))
+	if list == "*" {
+		m.any = true
+		return m, true
+	}
+
+	for list != "" {
+		var tag string
+		weak := strings.HasPrefix(list, "W/")
+		if weak {
+			list = list[2:]
+		}
+		// entity tags are quoted, and may contain commas
+		if !strings.HasPrefix(list, `"`) {
+			return m, false
+		}
+		end := strings.IndexByte(list[1:], '"')
+		if end < 0 {
+			return m, false
+		}
+		tag, list = list[1:end+1], strings.TrimSpace(list[end+2:])
+		if list != "" {
+			if list[0] != ',' {
+				return m, false
+			}
+			list = strings.TrimLeft(list[1:], " \t,")
+		}
+
+		// tags that aren't versions are valid, they just never match
+		if version, err := strconv.Atoi(tag); err == nil && version > 0 {
+			if weak {
+				m.weak = append(m.weak, version)
+			} else {
+				m.strong = append(m.strong, version)
+			}
 		}
-		players = append(players, p)
 	}
+	return m, true
+}
 
-	returnJSON(w, players)
+// matches reports whether the current version of a resource satisfies the header with strong
+// comparison, which If-Match uses, so weak tags never match.
+func (m entityTags) matches(version int) bool {
+	return !m.present || m.any || containsVersion(m.strong, version)
 }
 
-func addPlayerHandler(w http.ResponseWriter, r *http.Request) {
-	payload, err := io.ReadAll(r.Body)
+// matchesWeak reports whether the current version of a resource satisfies the header with weak
+// comparison, which If-None-Match uses, so weak tags match too.
+func (m entityTags) matchesWeak(version int) bool {
+	return m.matches(version) || containsVersion(m.weak, version)
+}
+
+func containsVersion(versions []int, version int) bool {
+	for _, v := range versions {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
+
+// notModified reports whether the If-None-Match header matches the current version of a resource,
+// so that it needn't be sent again. Malformed headers are ignored.
+func notModified(r *http.Request, version int) bool {
+	m, ok := parseEntityTags(r, "If-None-Match")
+	return ok && m.present && m.matchesWeak(version)
+}
+
+// matchVersion returns the version a change to a resource at the current version should be
+// conditional on, or writes 412 if the If-Match header doesn't match it. The version is 0, for an
+// unconditional change, if there is no If-Match header.
+func matchVersion(w http.ResponseWriter, r *http.Request, m entityTags, current int,
+	resource string) (int, bool) {
+	if !m.matches(current) {
+		modelErr(w, r, models.ErrVersionMismatch, resource)
+		return 0, false
+	} else if !m.present {
+		return 0, true
+	}
+	return current, true
+}
+
+// modelErr writes the response for an error from a models function on the named resource.
+func modelErr(w http.ResponseWriter, r *http.Request, err error, resource string) {
+	switch err {
+	case models.ErrNotFound:
+		httpErr(w, r, http.StatusNotFound, nil, resource+" not found")
+	case models.ErrConflict:
+		httpErr(w, r, http.StatusConflict, nil, resource+" already exists")
+	case models.ErrVersionMismatch:
+		if r.Header.Get("If-Match") != "" {
+			httpErr(w, r, http.StatusPreconditionFailed, nil, resource+" has been modified")
+		} else {
+			httpErr(w, r, http.StatusConflict, nil, resource+" was modified concurrently, try again")
+		}
+	default:
+		httpErr(w, r, 500, err)
+	}
+}
+
+// currentUser returns the logged in User. It is only nil on routes without requireUser.
+func currentUser(r *http.Request) *auth.User {
+	user, _ := auth.FromContext(r.Context())
+	return user
+}
+
+// ownedPlayer gets the player in the path, and writes an error response unless it belongs to the
+// logged in user.
+func ownedPlayer(w http.ResponseWriter, r *http.Request) (*models.Player, bool) {
+	user := currentUser(r)
+
+	id, ok := pathID(r)
+	if !ok {
+		modelErr(w, r, models.ErrNotFound, "player")
+		return nil, false
+	}
+
+	player, err := models.GetPlayer(r.Context(), id)
 	if err != nil {
-		httpErr(w, 400, err)
+		modelErr(w, r, err, "player")
+		return nil, false
+	}
+	if player.Owner != user.Email {
+		httpErr(w, r, http.StatusForbidden, nil, "player belongs to another user")
+		return nil, false
+	}
+	return player, true
+}
+
+// pathID parses the "id" path param.
+func pathID(r *http.Request) (int64, bool) {
+	id, err := strconv.ParseInt(pathParam(r, "id"), 10, 64)
+	return id, err == nil && id > 0
+}
+
+// respondPlayer writes the player with its ETag.
+func respondPlayer(w http.ResponseWriter, r *http.Request, statusCode int, p *models.Player) {
+	w.Header().Set("ETag", etag(p.Version))
+	respond(w, r, statusCode, p)
+}
+
+func getPlayerHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathID(r)
+	if !ok {
+		modelErr(w, r, models.ErrNotFound, "player")
+		return
+	}
+
+	player, err := models.GetPlayer(r.Context(), id)
+	if err != nil {
+		modelErr(w, r, err, "player")
+		return
+	}
+
+	if notModified(r, player.Version) {
+		w.Header().Set("ETag", etag(player.Version))
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	respondPlayer(w, r, http.StatusOK, player)
+}
+
+// replacePlayerHandler replaces an existing player, optionally only if it matches If-Match.
+func replacePlayerHandler(w http.ResponseWriter, r *http.Request) {
+	match, ok := ifMatch(r)
+	if !ok {
+		httpErr(w, r, http.StatusPreconditionFailed, nil, "invalid If-Match header")
+		return
+	}
+
+	existing, ok := ownedPlayer(w, r)
+	if !ok {
+		return
+	}
+	version, ok := matchVersion(w, r, match, existing.Version, "player")
+	if !ok {
 		return
 	}
 
 	var player models.Player
-	if err = json.Unmarshal(payload, &player); err != nil {
-		httpErr(w, 400, err, "problem reading player data")
+	if err := decodeBody(r, &player); err != nil {
+		decodeErr(w, r, err)
 		return
 	}
 
-	if err = validate.Struct(&player); err != nil {
-		validationErr(w, err)
+	if err := validate.Struct(&player); err != nil {
+		validationErr(w, r, err)
 		return
 	}
 
-	player.IP = r.RemoteAddr[:strings.LastIndexByte(r.RemoteAddr, ':')]
+	player.ID = existing.ID
+	player.LastIP = clientIP(r)
+	ctx := r.Context()
+
+	if err := player.Update(ctx, version); err != nil {
+		modelErr(w, r, err, "player")
+		return
+	}
+
+	saved, err := models.GetPlayer(ctx, player.ID)
+	if err != nil {
+		modelErr(w, r, err, "player")
+		return
+	}
+	respondPlayer(w, r, http.StatusOK, saved)
+}
+
+// patchPlayerHandler applies a JSON Merge Patch to a player.
+func patchPlayerHandler(w http.ResponseWriter, r *http.Request) {
+	match, ok := ifMatch(r)
+	if !ok {
+		httpErr(w, r, http.StatusPreconditionFailed, nil, "invalid If-Match header")
+		return
+	}
+
+	player, ok := ownedPlayer(w, r)
+	if !ok {
+		return
+	}
+
+	var patch map[string]interface{}
+	if err := decodeBody(r, &patch); err != nil {
+		decodeErr(w, r, err)
+		return
+	}
 
 	ctx := r.Context()
 
-	if err = player.Save(ctx); err != nil {
-		httpErr(w, 500, err, "could not save player data")
+	if !match.matches(player.Version) {
+		modelErr(w, r, models.ErrVersionMismatch, "player")
 		return
 	}
 
-	savedPlayer, err := models.GetPlayer(ctx, player.IP)
+	current, err := json.Marshal(player)
 	if err != nil {
-		httpErr(w, 500, err, "could not retrieve saved player")
+		httpErr(w, r, 500, err)
+		return
+	}
+	var doc interface{}
+	if err = json.Unmarshal(current, &doc); err != nil {
+		httpErr(w, r, 500, err)
+		return
+	}
+	patched, err := json.Marshal(mergePatch(doc, patch))
+	if err != nil {
+		httpErr(w, r, 500, err)
+		return
 	}
 
-	w.WriteHeader(http.StatusCreated)
-	returnJSON(w, &savedPlayer)
-}
+	updated := models.Player{Version: player.Version}
+	if err = decodeJSON(patched, &updated); err != nil {
+		httpErr(w, r, 400, err)
+		return
+	}
+	if err = validate.Struct(&updated); err != nil {
+		validationErr(w, r, err)
+		return
+	}
 
-func registerHandler(w http.ResponseWriter, r *http.Request) {
-	body, err := io.ReadAll(r.Body)
+	// the update is conditional on the version that was patched, so concurrent changes aren't lost
+	updated.ID = player.ID
+	updated.LastIP = clientIP(r)
+	if err = updated.Update(ctx, player.Version); err != nil {
+		modelErr(w, r, err, "player")
+		return
+	}
+
+	saved, err := models.GetPlayer(ctx, player.ID)
 	if err != nil {
-		httpErr(w, 400, err)
+		modelErr(w, r, err, "player")
+		return
+	}
+	respondPlayer(w, r, http.StatusOK, saved)
+}
+
+func deletePlayerHandler(w http.ResponseWriter, r *http.Request) {
+	match, ok := ifMatch(r)
+	if !ok {
+		httpErr(w, r, http.StatusPreconditionFailed, nil, "invalid If-Match header")
 		return
 	}
-	defer r.Body.Close()
 
+	player, ok := ownedPlayer(w, r)
+	if !ok {
+		return
+	}
+	version, ok := matchVersion(w, r, match, player.Version, "player")
+	if !ok {
+		return
+	}
+
+	if err := models.DeletePlayer(r.Context(), player.ID, version); err != nil {
+		modelErr(w, r, err, "player")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func registerHandler(w http.ResponseWriter, r *http.Request) {
 	var login login
-	if err = json.Unmarshal(body, &login); err != nil {
-		httpErr(w, 400, err)
+	if err := decodeBody(r, &login); err != nil {
+		decodeErr(w, r, err)
 		return
 	}
 
-	err = auth.CreateUser(r.Context(), login.Email, login.Password)
-	if err != nil {
-		httpErr(w, 500, err)
+	if err := validate.Struct(&login); err != nil {
+		validationErr(w, r, err)
+		return
+	}
+
+	err := auth.CreateUser(r.Context(), login.Email, login.Password)
+	if err == auth.ErrUserExists {
+		httpErr(w, r, http.StatusConflict, nil, "a user with that email already exists")
+		return
+	} else if err != nil {
+		httpErr(w, r, 500, err)
 		return
 	}
 
+	// the user can ask for another email if this one fails
+	if err = sendVerification(r, login.Email); err != nil {
+		log.Println("UNHANDLED:", err)
+	}
+
 	w.WriteHeader(http.StatusNoContent)
 }
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// trustedProxies are the networks whose X-Forwarded-For and Forwarded headers are believed.
+var trustedProxies []*net.IPNet
+
+// parseTrustedProxies parses a list of IP addresses and CIDR ranges.
+func parseTrustedProxies(list []string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, item := range list {
+		if !strings.Contains(item, "/") {
+			if ip := net.ParseIP(item); ip != nil && ip.To4() != nil {
+				item += "/32"
+			} else {
+				item += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(item)
+		if err != nil {
+			log.Fatalf("Invalid trusted proxy %q: %s", item, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
+
+func isTrusted(ip net.IP) bool {
+	for _, n := range trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address of the client that made the request. Forwarding headers are only
+// used when the request came from a trusted proxy, in which case the hops are walked from the
+// nearest until one that isn't a trusted proxy is found.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return host
+	}
+
+	hops := forwardedFor(r)
+	for i := len(hops) - 1; i >= 0 && isTrusted(ip); i-- {
+		hop := net.ParseIP(hops[i])
+		if hop == nil {
+			break
+		}
+		ip = hop
+	}
+	return ip.String()
+}
+
+// forwardedFor returns the client addresses from the Forwarded header, or from X-Forwarded-For
+// if there is no Forwarded header, ordered from the original client to the nearest proxy.
+func forwardedFor(r *http.Request) []string {
+	var hops []string
+
+	if forwarded := r.Header.Values("Forwarded"); len(forwarded) != 0 {
+		for _, element := range strings.Split(strings.Join(forwarded, ","), ",") {
+			for _, pair := range strings.Split(element, ";") {
+				k, v, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if !ok || !strings.EqualFold(k, "for") {
+					continue
+				}
+				// e.g. for="[2001:db8::1]:4711" or for=192.0.2.60
+				v = strings.Trim(v, `"`)
+				if h, _, err := net.SplitHostPort(v); err == nil {
+					v = h
+				}
+				hops = append(hops, strings.Trim(v, "[]"))
+			}
+		}
+		return hops
+	}
+
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(header, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				hops = append(hops, hop)
+			}
+		}
+	}
+	return hops
+}
@@ -0,0 +1,27 @@
+package mail
+
+import (
+	"context"
+	"sync"
+)
+
+// CaptureSender keeps messages in memory instead of sending them, for tests.
+type CaptureSender struct {
+	mu       sync.Mutex
+	messages []Message
+}
+
+// Send implements Sender.
+func (s *CaptureSender) Send(ctx context.Context, m *Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.messages = append(s.messages, *m)
+	return nil
+}
+
+// Messages returns the messages sent so far.
+func (s *CaptureSender) Messages() []Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Message{}, s.messages...)
+}
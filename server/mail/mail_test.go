@@ -0,0 +1,151 @@
+package mail
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTemplates(t *testing.T) {
+	templates, err := DefaultTemplates()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		languages []string
+		subject   string
+	}{
+		{nil, "Verify your email address"},
+		{[]string{"de_AT", "de"}, "Bestätige deine E-Mail-Adresse"},
+		{[]string{"nl", "fr"}, "Vérifiez votre adresse e-mail"},
+		{[]string{"nl"}, "Verify your email address"},
+	}
+
+	for _, tc := range cases {
+		m, err := templates.Render("verify", tc.languages, struct {
+			Link  string
+			Hours int
+		}{"http://x/verify?token=a&b", 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.Subject != tc.subject {
+			t.Fatalf("%v: got subject %q; want %q", tc.languages, m.Subject, tc.subject)
+		}
+		if !strings.Contains(m.Text, "http://x/verify?token=a&b") || !strings.Contains(m.HTML, "token=a&amp;b") {
+			t.Fatalf("%v: got text %q and HTML %q; want the link in both", tc.languages, m.Text, m.HTML)
+		}
+	}
+}
+
+func TestMessage(t *testing.T) {
+	m := &Message{From: "a@b.c", To: "d@e.f", Subject: "Grüße", Text: "hi", HTML: "<p>hi</p>"}
+	b, err := m.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"Subject: =?utf-8?q?Gr=C3=BC=C3=9Fe?=\r\n", "multipart/alternative", "text/html"} {
+		if !bytes.Contains(b, []byte(want)) {
+			t.Fatalf("got %q; want it to contain %q", b, want)
+		}
+	}
+
+	m.To = "d@e.f\r\nBcc: g@h.i"
+	if _, err = m.Bytes(); err != ErrBadHeader {
+		t.Fatalf("got %v with a line break in To; want %v", err, ErrBadHeader)
+	}
+}
+
+func TestMaildir(t *testing.T) {
+	dir := t.TempDir()
+	s := &MaildirSender{Dir: dir}
+	if err := s.Send(context.Background(), &Message{From: "a@b.c", To: "d@e.f", Text: "hi"}); err != nil {
+		t.Fatal(err)
+	}
+	files, err := os.ReadDir(dir + "/new")
+	if err != nil || len(files) != 1 {
+		t.Fatalf("got %d files, %v in new; want 1", len(files), err)
+	}
+}
+
+// flakySender fails sends to the addresses in failures, as many times as their count or forever
+// if it is negative, and captures the rest.
+type flakySender struct {
+	CaptureSender
+	mu       sync.Mutex
+	failures map[string]int
+}
+
+func (s *flakySender) Send(ctx context.Context, m *Message) error {
+	s.mu.Lock()
+	n := s.failures[m.To]
+	if n > 0 {
+		s.failures[m.To]--
+	}
+	s.mu.Unlock()
+	if n != 0 {
+		return errors.New("unavailable")
+	}
+	return s.CaptureSender.Send(ctx, m)
+}
+
+func TestQueue(t *testing.T) {
+	sender := &flakySender{failures: map[string]int{"a@b.c": 2, "d@e.f": 1}}
+	q := NewQueue(sender, 10, 2, time.Millisecond, time.Second)
+	for _, to := range []string{"a@b.c", "d@e.f", "g@h.i"} {
+		if err := q.Send(context.Background(), &Message{To: to}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := q.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if sent := sender.Messages(); len(sent) != 3 {
+		t.Fatalf("got %v sent; want all messages after retrying", sent)
+	}
+}
+
+func TestQueueRetryDoesNotBlock(t *testing.T) {
+	sender := &flakySender{failures: map[string]int{"a@b.c": -1}}
+	q := NewQueue(sender, 10, 5, time.Hour, time.Second)
+	for _, to := range []string{"a@b.c", "d@e.f"} {
+		if err := q.Send(context.Background(), &Message{To: to}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the second message is sent while the first waits an hour to be retried
+	deadline := time.Now().Add(5 * time.Second)
+	for len(sender.Messages()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("got nothing sent; want the second message sent without waiting for the first")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if sent := sender.Messages(); len(sent) != 1 || sent[0].To != "d@e.f" {
+		t.Fatalf("got %v sent; want only the second message", sent)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := q.Close(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("got %v closing; want %v for the message waiting to be retried", err, context.DeadlineExceeded)
+	}
+}
+
+func TestSMTPUnknownTLS(t *testing.T) {
+	for _, mode := range []string{"", "ssl", "true", "STARTTLS"} {
+		// nothing listens on the port, so sending would fail differently if it got that far
+		s := &SMTPSender{Host: "127.0.0.1", Port: 1, TLS: mode}
+		if err := s.Send(context.Background(), &Message{From: "a@b.c", To: "d@e.f", Text: "hi"}); err != ErrTLSMode {
+			t.Errorf("%q: got %v; want %v", mode, err, ErrTLSMode)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package mail
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// MaildirSender delivers messages to a local maildir instead of sending them, so that they can be
+// read with a mail client in development.
+type MaildirSender struct {
+	Dir string
+}
+
+// Send implements Sender.
+func (s *MaildirSender) Send(ctx context.Context, m *Message) error {
+	data, err := m.Bytes()
+	if err != nil {
+		return err
+	}
+
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err = os.MkdirAll(filepath.Join(s.Dir, sub), 0700); err != nil {
+			return err
+		}
+	}
+
+	unique := make([]byte, 8)
+	if _, err = rand.Read(unique); err != nil {
+		return err
+	}
+	host, _ := os.Hostname()
+	name := fmt.Sprintf("%d.%d_%s.%s", time.Now().Unix(), os.Getpid(), hex.EncodeToString(unique), host)
+
+	// messages are written to tmp and moved to new, so readers never see half a message
+	tmp := filepath.Join(s.Dir, "tmp", name)
+	if err = os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, filepath.Join(s.Dir, "new", name)); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
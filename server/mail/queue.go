@@ -0,0 +1,118 @@
+package mail
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// ErrQueueFull is returned by Queue.Send when there is no room for another message.
+var ErrQueueFull = errors.New("Mail queue full")
+
+// Queue sends messages in the background with another Sender, so that requests don't wait on it,
+// retrying failures with exponential backoff. Messages waiting to be retried don't hold up the
+// ones queued after them.
+type Queue struct {
+	sender  Sender
+	retries int
+	backoff time.Duration
+	timeout time.Duration
+
+	messages chan *Message
+	// retrying counts the messages waiting to be retried
+	retrying sync.WaitGroup
+	done     chan struct{}
+	stop     context.CancelFunc
+	ctx      context.Context
+}
+
+// NewQueue starts a Queue holding up to size messages, which sends each message with at most
+// retries retries, waiting backoff before the first and twice as long before each after that.
+// Each attempt is given up to timeout.
+func NewQueue(sender Sender, size, retries int, backoff, timeout time.Duration) *Queue {
+	ctx, stop := context.WithCancel(context.Background())
+	q := &Queue{
+		sender:   sender,
+		retries:  retries,
+		backoff:  backoff,
+		timeout:  timeout,
+		messages: make(chan *Message, size),
+		done:     make(chan struct{}),
+		stop:     stop,
+		ctx:      ctx,
+	}
+	go q.run()
+	return q
+}
+
+// Send implements Sender by queuing a copy of the message. ctx is only used for queuing.
+func (q *Queue) Send(ctx context.Context, m *Message) error {
+	c := *m
+	select {
+	case q.messages <- &c:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+		return ErrQueueFull
+	}
+}
+
+func (q *Queue) run() {
+	defer close(q.done)
+	for m := range q.messages {
+		if err := q.attempt(m); err != nil {
+			q.retrying.Add(1)
+			go q.retry(m, err)
+		}
+	}
+	q.retrying.Wait()
+}
+
+// attempt sends the message once.
+func (q *Queue) attempt(m *Message) error {
+	ctx, cancel := context.WithTimeout(q.ctx, q.timeout)
+	defer cancel()
+	return q.sender.Send(ctx, m)
+}
+
+// retry sends a message that failed with err again, until it succeeds, runs out of retries, or the
+// queue is stopped. It runs in its own goroutine, so that the backoff doesn't delay other messages.
+func (q *Queue) retry(m *Message, err error) {
+	defer q.retrying.Done()
+
+	wait := q.backoff
+	for retries := 0; err != nil; retries++ {
+		if retries >= q.retries {
+			log.Printf("UNHANDLED: giving up on mail to %s: %v", m.To, err)
+			return
+		}
+		log.Printf("Retrying mail to %s in %s: %v", m.To, wait, err)
+
+		select {
+		case <-time.After(wait):
+		case <-q.ctx.Done():
+			log.Printf("UNHANDLED: dropped mail to %s: %v", m.To, err)
+			return
+		}
+		err = q.attempt(m)
+		wait *= 2
+	}
+}
+
+// Close stops accepting messages and waits for the queued ones to be sent, including those waiting
+// to be retried. If ctx is done first, the messages that haven't been sent are dropped and logged.
+// Send must not be called after Close.
+func (q *Queue) Close(ctx context.Context) error {
+	close(q.messages)
+	select {
+	case <-q.done:
+		return nil
+	case <-ctx.Done():
+		q.stop()
+		<-q.done
+		return ctx.Err()
+	}
+}
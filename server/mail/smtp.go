@@ -0,0 +1,101 @@
+package mail
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+)
+
+// TLS modes for SMTPSender.
+const (
+	// TLSNone sends in plain text, which is only suitable for a local relay.
+	TLSNone = "none"
+	// TLSStartTLS upgrades the connection with STARTTLS, usually on port 587.
+	TLSStartTLS = "starttls"
+	// TLSImplicit connects with TLS, usually on port 465.
+	TLSImplicit = "tls"
+)
+
+// ErrTLSMode is returned by SMTPSender.Send when its TLS isn't one of the TLS modes, rather than
+// sending without TLS.
+var ErrTLSMode = errors.New("Unknown SMTP TLS mode")
+
+// SMTPSender sends messages to an SMTP server, logging in if Username is set. TLS is one of the
+// TLS modes.
+type SMTPSender struct {
+	Host     string
+	Port     int
+	TLS      string
+	Username string
+	Password string
+}
+
+// Send implements Sender.
+func (s *SMTPSender) Send(ctx context.Context, m *Message) error {
+	switch s.TLS {
+	case TLSNone, TLSStartTLS, TLSImplicit:
+	default:
+		return ErrTLSMode
+	}
+
+	data, err := m.Bytes()
+	if err != nil {
+		return err
+	}
+
+	addr := net.JoinHostPort(s.Host, fmt.Sprint(s.Port))
+	dialer := &net.Dialer{}
+	var conn net.Conn
+	if s.TLS == TLSImplicit {
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: &tls.Config{ServerName: s.Host}}).DialContext(ctx, "tcp", addr)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	c, err := smtp.NewClient(conn, s.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if s.TLS == TLSStartTLS {
+		if err = c.StartTLS(&tls.Config{ServerName: s.Host}); err != nil {
+			return err
+		}
+	}
+	if s.Username != "" {
+		// PlainAuth refuses to send the password without TLS, except to localhost
+		if err = c.Auth(smtp.PlainAuth("", s.Username, s.Password, s.Host)); err != nil {
+			return err
+		}
+	}
+
+	if err = c.Mail(address(m.From)); err != nil {
+		return err
+	}
+	if err = c.Rcpt(address(m.To)); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(data); err != nil {
+		w.Close()
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
@@ -0,0 +1,96 @@
+package mail
+
+import (
+	"bytes"
+	"embed"
+	htmltemplate "html/template"
+	"io/fs"
+	"path"
+	"strings"
+	texttemplate "text/template"
+)
+
+// DefaultLanguage is used for messages without a template in any of the wanted languages.
+const DefaultLanguage = "en"
+
+//go:embed templates
+var templateFiles embed.FS
+
+// Templates render messages from a text template, which also defines the "subject" template, and
+// an optional HTML template for each name and language. They are in files named like
+// "verify.en.txt" and "verify.en.html".
+type Templates struct {
+	text map[string]*texttemplate.Template
+	html map[string]*htmltemplate.Template
+}
+
+// DefaultTemplates loads the templates built into the server.
+func DefaultTemplates() (*Templates, error) {
+	fsys, err := fs.Sub(templateFiles, "templates")
+	if err != nil {
+		return nil, err
+	}
+	return LoadTemplates(fsys)
+}
+
+// LoadTemplates loads the templates in the root of fsys.
+func LoadTemplates(fsys fs.FS) (*Templates, error) {
+	t := &Templates{text: map[string]*texttemplate.Template{}, html: map[string]*htmltemplate.Template{}}
+
+	for _, ext := range []string{".txt", ".html"} {
+		files, err := fs.Glob(fsys, "*.*"+ext)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			b, err := fs.ReadFile(fsys, file)
+			if err != nil {
+				return nil, err
+			}
+			key := strings.TrimSuffix(path.Base(file), ext)
+			if ext == ".txt" {
+				t.text[key], err = texttemplate.New(file).Parse(string(b))
+			} else {
+				t.html[key], err = htmltemplate.New(file).Parse(string(b))
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return t, nil
+}
+
+// Render renders the named message in the first of the languages it has a template for, or in
+// DefaultLanguage. Languages are tags like "de" or "en_US". The message has no From or To.
+func (t *Templates) Render(name string, languages []string, data interface{}) (*Message, error) {
+	var key string
+	for _, lang := range append(append([]string{}, languages...), DefaultLanguage) {
+		if _, ok := t.text[name+"."+strings.ToLower(lang)]; ok {
+			key = name + "." + strings.ToLower(lang)
+			break
+		}
+	}
+	text, ok := t.text[key]
+	if !ok {
+		return nil, fs.ErrNotExist
+	}
+
+	var subject, body bytes.Buffer
+	if err := text.ExecuteTemplate(&subject, "subject", data); err != nil {
+		return nil, err
+	}
+	if err := text.Execute(&body, data); err != nil {
+		return nil, err
+	}
+	m := &Message{Subject: strings.TrimSpace(subject.String()), Text: strings.TrimSpace(body.String()) + "\n"}
+
+	if html, ok := t.html[key]; ok {
+		var b bytes.Buffer
+		if err := html.Execute(&b, data); err != nil {
+			return nil, err
+		}
+		m.HTML = b.String()
+	}
+	return m, nil
+}
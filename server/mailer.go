@@ -0,0 +1,76 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/calvinsomething/go-proj/mail"
+)
+
+type (
+	// linkMail is the data for templates of emails with an expiring link.
+	linkMail struct {
+		Link  string
+		Hours int
+	}
+)
+
+var (
+	mailer        mail.Sender = mail.LogSender{}
+	mailTemplates *mail.Templates
+	// mailFrom is the From address of emails
+	mailFrom string
+)
+
+// mailQueueFromEnv returns a queue sending with the backend named by MAIL_BACKEND: "log" (the
+// default), "smtp" or "maildir".
+func mailQueueFromEnv() *mail.Queue {
+	var sender mail.Sender
+	switch backend := envString("MAIL_BACKEND", "log"); backend {
+	case "log":
+		sender = mail.LogSender{}
+	case "smtp":
+		// anything else would be sent without TLS, so typos mustn't start the server
+		tlsMode := envString("SMTP_TLS", mail.TLSStartTLS)
+		switch tlsMode {
+		case mail.TLSNone, mail.TLSStartTLS, mail.TLSImplicit:
+		default:
+			log.Fatalf("Invalid SMTP_TLS: %q, it must be %q, %q or %q", tlsMode, mail.TLSStartTLS, mail.TLSImplicit,
+				mail.TLSNone)
+		}
+		sender = &mail.SMTPSender{
+			Host:     envString("SMTP_HOST", "localhost"),
+			Port:     envInt("SMTP_PORT", 587),
+			TLS:      tlsMode,
+			Username: envString("SMTP_USERNAME", ""),
+			Password: envString("SMTP_PASSWORD", ""),
+		}
+	case "maildir":
+		sender = &mail.MaildirSender{Dir: envString("MAILDIR", "maildir")}
+	default:
+		log.Fatalf("Invalid MAIL_BACKEND: %q", backend)
+	}
+
+	return mail.NewQueue(sender,
+		envInt("MAIL_QUEUE_SIZE", 100),
+		envInt("MAIL_RETRIES", 5),
+		envDuration("MAIL_RETRY_BACKOFF", 30*time.Second),
+		envDuration("MAIL_TIMEOUT", 30*time.Second),
+	)
+}
+
+// hours rounds d up to whole hours, for telling users when links expire.
+func hours(d time.Duration) int {
+	return int((d + time.Hour - 1) / time.Hour)
+}
+
+// sendMail renders the named email in the request's language and sends it to the address.
+func sendMail(r *http.Request, to, name string, data interface{}) error {
+	m, err := mailTemplates.Render(name, acceptedLanguages(r), data)
+	if err != nil {
+		return err
+	}
+	m.From, m.To = mailFrom, to
+	return mailer.Send(r.Context(), m)
+}
@@ -1,10 +1,222 @@
 package main
 
 import (
+	"context"
 	"log"
 	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/calvinsomething/go-proj/auth"
 )
 
-func logger(w http.ResponseWriter, r *http.Request) {
-	log.Println(r.URL.Path, r.Header)
+// statusRecorder captures the status code written by the handlers it wraps.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sr *statusRecorder) WriteHeader(statusCode int) {
+	sr.status = statusCode
+	sr.ResponseWriter.WriteHeader(statusCode)
+}
+
+// logger logs each request's id, method, path, status and duration. Headers are left out, since
+// the session cookie in them would let anyone reading the logs take over the session.
+func logger(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sr := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+
+		next.ServeHTTP(sr, r)
+
+		log.Println(requestIDFrom(r.Context()), r.Method, r.URL.Path, sr.status, time.Since(start))
+	})
+}
+
+type corsConfig struct {
+	// AllowedOrigins may contain "*" to allow any origin.
+	AllowedOrigins   []string
+	AllowedMethods   []string
+	AllowedHeaders   []string
+	ExposedHeaders   []string
+	AllowCredentials bool
+	// MaxAge is how long browsers may cache preflight responses.
+	MaxAge time.Duration
+}
+
+// corsConfigFromEnv reads the CORS_* environment variables. By default only the client running
+// on CLIENT_PORT is allowed, with credentials so that the session cookie is sent. Allowing any
+// origin with "*" turns credentials off by default, and turning them on as well is refused, since
+// every website could then make requests with the user's session.
+func corsConfigFromEnv() corsConfig {
+	var origins []string
+	if port := os.Getenv("CLIENT_PORT"); port != "" {
+		origins = []string{"http://localhost:" + port, "http://127.0.0.1:" + port}
+	}
+	origins = envList("CORS_ALLOWED_ORIGINS", origins...)
+
+	anyOrigin := false
+	for _, o := range origins {
+		anyOrigin = anyOrigin || o == "*"
+	}
+	credentials := envBool("CORS_ALLOW_CREDENTIALS", !anyOrigin)
+	if anyOrigin && credentials {
+		log.Fatal("CORS_ALLOWED_ORIGINS=* can't be used with CORS_ALLOW_CREDENTIALS=true")
+	}
+
+	return corsConfig{
+		AllowedOrigins: origins,
+		AllowedMethods: envList("CORS_ALLOWED_METHODS",
+			http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete),
+		AllowedHeaders:   envList("CORS_ALLOWED_HEADERS", "Accept", "Accept-Language", "Content-Type", "If-Match", "If-None-Match"),
+		ExposedHeaders:   envList("CORS_EXPOSED_HEADERS", "ETag", "X-Request-ID", "X-Total-Count", "Link"),
+		AllowCredentials: credentials,
+		MaxAge:           envDuration("CORS_MAX_AGE", 10*time.Minute),
+	}
+}
+
+// allowsOrigin reports whether the origin is allowed, and whether it is listed rather than only
+// allowed by "*".
+func (c corsConfig) allowsOrigin(origin string) (allowed, listed bool) {
+	for _, o := range c.AllowedOrigins {
+		if strings.EqualFold(o, origin) {
+			return true, true
+		}
+		allowed = allowed || o == "*"
+	}
+	return allowed, false
+}
+
+// cors adds the CORS headers for allowed origins and answers preflight requests itself.
+func cors(cfg corsConfig) middleware {
+	methods := strings.Join(cfg.AllowedMethods, ", ")
+	headers := strings.Join(cfg.AllowedHeaders, ", ")
+	exposed := strings.Join(cfg.ExposedHeaders, ", ")
+	maxAge := strconv.Itoa(int(cfg.MaxAge.Seconds()))
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			origin := r.Header.Get("Origin")
+			w.Header().Add("Vary", "Origin")
+			allowed, listed := cfg.allowsOrigin(origin)
+			if origin == "" || !allowed {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			// listed origins are echoed rather than "*" since browsers reject "*" with credentials,
+			// and origins only allowed by "*" never get credentials
+			if listed {
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+				if cfg.AllowCredentials {
+					w.Header().Set("Access-Control-Allow-Credentials", "true")
+				}
+			} else {
+				w.Header().Set("Access-Control-Allow-Origin", "*")
+			}
+
+			if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+				w.Header().Add("Vary", "Access-Control-Request-Method")
+				w.Header().Add("Vary", "Access-Control-Request-Headers")
+				w.Header().Set("Access-Control-Allow-Methods", methods)
+				w.Header().Set("Access-Control-Allow-Headers", headers)
+				w.Header().Set("Access-Control-Max-Age", maxAge)
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+
+			if exposed != "" {
+				w.Header().Set("Access-Control-Expose-Headers", exposed)
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+type requestIDKey struct{}
+
+// requestID tags each request with an id, reusing a sane X-Request-ID from the client or proxy,
+// and echoes it in the response so that problem responses can be matched to the logs.
+func requestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if id == "" || len(id) > 64 || strings.ContainsAny(id, " \t\r\n") {
+			id = uuid.NewString()
+		}
+
+		w.Header().Set("X-Request-ID", id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+func requestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// sessionCookie is the name of the cookie holding the session id.
+const sessionCookie = "session"
+
+// setSessionCookie sets the session cookie to the session id, lasting maxAge.
+func setSessionCookie(w http.ResponseWriter, r *http.Request, sid string, maxAge time.Duration) {
+	setCookie(w, r, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    sid,
+		MaxAge:   int(maxAge.Seconds()),
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// expireSessionCookie tells the client to drop the session cookie.
+func expireSessionCookie(w http.ResponseWriter, r *http.Request) {
+	setCookie(w, r, &http.Cookie{Name: sessionCookie, MaxAge: -1, HttpOnly: true, SameSite: http.SameSiteStrictMode})
+}
+
+// authenticate resolves the session cookie to the logged in User and stores it in the request
+// context. Requests without a valid session continue anonymously, see requireUser. When using the
+// session refreshes it, the cookie is set again so that it lasts as long as the session.
+func authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cookie, err := r.Cookie(sessionCookie)
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		user, maxAge, err := auth.GetUser(r.Context(), cookie.Value)
+		switch err {
+		case nil:
+			if maxAge > 0 {
+				setSessionCookie(w, r, cookie.Value, maxAge)
+			}
+			r = r.WithContext(auth.NewContext(r.Context(), user))
+		case auth.ErrNoSession, auth.ErrSessionExpired, auth.ErrBadMAC:
+			// the session is no use anymore, so the client should drop the cookie
+			expireSessionCookie(w, r)
+		case auth.ErrUnknownKey:
+			// the session is kept, since servers with the key can still use it, so the cookie is too
+		default:
+			httpErr(w, r, 500, err)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requireUser protects a route or group, responding with 401 unless there is a logged in User.
+func requireUser(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := auth.FromContext(r.Context()); !ok {
+			httpErr(w, r, http.StatusUnauthorized, nil, "you must be logged in")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
 }
@@ -0,0 +1,222 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/calvinsomething/go-proj/db"
+)
+
+type (
+	// Character reflects a row in the characters table. Each user has exactly one main Character
+	// as long as they have any.
+	Character struct {
+		ID          int64   `json:"id"`
+		Name        string  `json:"name" validate:"min=2,max=12,alphaunicode"`
+		Realm       string  `json:"realm" validate:"min=1,max=50"`
+		Level       int     `json:"level" validate:"min=1,max=60"`
+		Faction     string  `json:"faction"`
+		Race        string  `json:"race" validate:"oneof=dwarf gnome human 'night elf' orc tauren troll undead"`
+		Class       string  `json:"class" validate:"oneof=druid hunter mage paladin priest rogue shaman warlock warrior"`
+		Profession1 *string `json:"profession1" validate:"omitempty,oneof=alchemy blacksmithing enchanting engineering herbalism mining tailoring"`
+		Profession2 *string `json:"profession2" validate:"omitempty,oneof=alchemy blacksmithing enchanting engineering herbalism mining tailoring,nefield=Profession1"`
+		Main        bool    `json:"main"`
+		// Owner is the email of the User the Character belongs to.
+		Owner string `json:"-"`
+		// Version is incremented on every update and is used for optimistic concurrency.
+		Version int `json:"-"`
+	}
+)
+
+// ErrConflict is returned when a row would duplicate a unique value of another row.
+var ErrConflict = errors.New("already exists")
+
+const characterColumns = `id, name, realm, level, faction, race, class, profession1, profession2,
+	is_main, user_email, version`
+
+func scanCharacter(row scanner) (*Character, error) {
+	c := &Character{}
+	err := row.Scan(&c.ID, &c.Name, &c.Realm, &c.Level, &c.Faction, &c.Race, &c.Class, &c.Profession1,
+		&c.Profession2, &c.Main, &c.Owner, &c.Version)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	return c, err
+}
+
+// GetCharacters returns the user's characters, main first.
+func GetCharacters(ctx context.Context, owner string) ([]*Character, error) {
+	rows, err := db.Pool.QueryContext(ctx, `
+		SELECT `+characterColumns+`
+		FROM characters
+		WHERE user_email = ?
+		ORDER BY is_main DESC, id;
+	`, owner)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	characters := []*Character{}
+	for rows.Next() {
+		c, err := scanCharacter(rows)
+		if err != nil {
+			return nil, err
+		}
+		characters = append(characters, c)
+	}
+	return characters, rows.Err()
+}
+
+// GetCharacter gets the user's Character with the id. Characters of other users are not found.
+func GetCharacter(ctx context.Context, owner string, id int64) (*Character, error) {
+	return scanCharacter(db.Pool.QueryRowContext(ctx, `
+		SELECT `+characterColumns+`
+		FROM characters
+		WHERE id = ? AND user_email = ?;
+	`, id, owner))
+}
+
+// Create inserts the Character and sets its ID. It becomes the main if it is marked as main or is
+// the owner's first character.
+func (c *Character) Create(ctx context.Context) error {
+	err := db.Pool.InTx(ctx, func(tx *sql.Tx) error {
+		var hasMain bool
+		err := tx.QueryRowContext(ctx, `
+			SELECT COUNT(*) > 0
+			FROM characters
+			WHERE user_email = ? AND is_main
+			FOR UPDATE;
+		`, c.Owner).Scan(&hasMain)
+		if err != nil {
+			return err
+		}
+
+		if c.claimMain(hasMain) {
+			if err = clearMain(ctx, tx, c.Owner); err != nil {
+				return err
+			}
+		}
+
+		res, err := tx.ExecContext(ctx, `
+			INSERT INTO characters (user_email, name, realm, level, race, class, profession1, profession2, is_main,
+				main_of)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, IF(?, ?, NULL));
+		`, c.Owner, c.Name, c.Realm, c.Level, c.Race, c.Class, c.Profession1, c.Profession2, c.Main, c.Main, c.Owner)
+		if err != nil {
+			return err
+		}
+		c.ID, err = res.LastInsertId()
+		return err
+	})
+	if db.IsDuplicate(err) {
+		return ErrConflict
+	}
+	return err
+}
+
+// claimMain makes a new Character the main if it is marked as main or its owner has no main, and
+// reports whether the owner's current main has to be cleared first.
+func (c *Character) claimMain(hasMain bool) (clear bool) {
+	clear = c.Main && hasMain
+	c.Main = c.Main || !hasMain
+	return clear
+}
+
+// Update replaces the stored Character, except for whether it is the main, as long as it is
+// still at the given version. A version of 0 updates the Character regardless.
+func (c *Character) Update(ctx context.Context, version int) error {
+	err := db.Pool.MustAffect(ctx, `
+		UPDATE characters
+		SET name = ?, realm = ?, level = ?, race = ?, class = ?, profession1 = ?, profession2 = ?,
+			version = version + 1
+		WHERE id = ? AND user_email = ? AND (? = 0 OR version = ?);
+	`, c.Name, c.Realm, c.Level, c.Race, c.Class, c.Profession1, c.Profession2, c.ID, c.Owner, version, version)
+	if db.IsDuplicate(err) {
+		return ErrConflict
+	} else if err == db.ErrNoEffect {
+		if _, err = GetCharacter(ctx, c.Owner, c.ID); err != nil {
+			return err
+		}
+		return ErrVersionMismatch
+	}
+	return err
+}
+
+// DeleteCharacter deletes the user's Character with the id, as long as it is still at the given
+// version. A version of 0 deletes the Character regardless. If it was the main, the user's oldest
+// remaining character becomes the main.
+func DeleteCharacter(ctx context.Context, owner string, id int64, version int) error {
+	return db.Pool.InTx(ctx, func(tx *sql.Tx) error {
+		var isMain bool
+		var current int
+		err := tx.QueryRowContext(ctx, `
+			SELECT is_main, version
+			FROM characters
+			WHERE id = ? AND user_email = ?
+			FOR UPDATE;
+		`, id, owner).Scan(&isMain, &current)
+		if err == sql.ErrNoRows {
+			return ErrNotFound
+		} else if err != nil {
+			return err
+		} else if version != 0 && version != current {
+			return ErrVersionMismatch
+		}
+
+		if _, err = tx.ExecContext(ctx, `DELETE FROM characters WHERE id = ?;`, id); err != nil {
+			return err
+		}
+		if !isMain {
+			return nil
+		}
+
+		_, err = tx.ExecContext(ctx, `
+			UPDATE characters
+			SET is_main = TRUE, main_of = user_email, version = version + 1
+			WHERE user_email = ?
+			ORDER BY id
+			LIMIT 1;
+		`, owner)
+		return err
+	})
+}
+
+// SetMainCharacter makes the user's Character with the id their main.
+func SetMainCharacter(ctx context.Context, owner string, id int64) error {
+	return db.Pool.InTx(ctx, func(tx *sql.Tx) error {
+		var exists bool
+		err := tx.QueryRowContext(ctx, `
+			SELECT COUNT(*) > 0
+			FROM characters
+			WHERE id = ? AND user_email = ?
+			FOR UPDATE;
+		`, id, owner).Scan(&exists)
+		if err != nil {
+			return err
+		} else if !exists {
+			return ErrNotFound
+		}
+
+		if err = clearMain(ctx, tx, owner); err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `
+			UPDATE characters
+			SET is_main = TRUE, main_of = user_email, version = version + 1
+			WHERE id = ?;
+		`, id)
+		return err
+	})
+}
+
+// clearMain unsets the user's main character, so that another can be set within the transaction.
+func clearMain(ctx context.Context, tx *sql.Tx, owner string) error {
+	_, err := tx.ExecContext(ctx, `
+		UPDATE characters
+		SET is_main = FALSE, main_of = NULL, version = version + 1
+		WHERE user_email = ? AND is_main;
+	`, owner)
+	return err
+}
@@ -0,0 +1,24 @@
+package models
+
+import "testing"
+
+func TestClaimMain(t *testing.T) {
+	cases := []struct {
+		main, hasMain bool
+		wantMain      bool
+		wantClear     bool
+	}{
+		{false, false, true, false},
+		{true, false, true, false},
+		{false, true, false, false},
+		{true, true, true, true},
+	}
+
+	for _, tc := range cases {
+		c := Character{Main: tc.main}
+		if clear := c.claimMain(tc.hasMain); c.Main != tc.wantMain || clear != tc.wantClear {
+			t.Errorf("main %t, has main %t: got %t, %t; want %t, %t", tc.main, tc.hasMain, c.Main, clear,
+				tc.wantMain, tc.wantClear)
+		}
+	}
+}
@@ -2,6 +2,8 @@ package models
 
 import (
 	"context"
+	"database/sql"
+	"errors"
 
 	"github.com/calvinsomething/go-proj/db"
 )
@@ -9,58 +11,172 @@ import (
 type (
 	// Player reflects a row in the players table.
 	Player struct {
-		IP          string  `json:"ip"`
+		ID          int64   `json:"id"`
 		Faction     string  `json:"faction"`
-		Race        string  `json:"race" validate:"oneof=dwarf gnome human night elf orc tauren troll undead"`
+		Race        string  `json:"race" validate:"oneof=dwarf gnome human 'night elf' orc tauren troll undead"`
 		Class       string  `json:"class" validate:"oneof=druid hunter mage paladin priest rogue shaman warlock warrior"`
 		Profession1 *string `json:"profession1" validate:"oneof=alchemy blacksmithing enchanting engineering herbalism mining tailoring"`
 		Profession2 *string `json:"profession2" validate:"oneof=alchemy blacksmithing enchanting engineering herbalism mining tailoring,nefield=Profession1"`
 		WeeklyHours *int    `json:"weeklyHours" validate:"gt=0,lt=51"`
+		// Owner is the email of the User the Player belongs to. It is empty for players created
+		// before players were linked to users.
+		Owner string `json:"-"`
+		// CreatedIP and LastIP are the client addresses that created and last saved the Player.
+		CreatedIP string `json:"-"`
+		LastIP    string `json:"-"`
+		// Version is incremented on every update and is used for optimistic concurrency.
+		Version int `json:"-"`
+	}
+
+	scanner interface {
+		Scan(dest ...interface{}) error
 	}
 )
 
-// GetPlayer gets the Player associated with the ip address.
-func GetPlayer(ctx context.Context, ip string) (p *Player, err error) {
-	p.IP = ip
-	err = db.Pool.QueryRowContext(ctx, `
-		SELECT faction, race, class, profession1, profession2, weekly_hours
+var (
+	// ErrNotFound is returned when the requested row does not exist.
+	ErrNotFound = errors.New("not found")
+	// ErrVersionMismatch is returned when a row has changed since the given version was read.
+	ErrVersionMismatch = errors.New("version does not match")
+)
+
+const playerColumns = `id, faction, race, class, profession1, profession2, weekly_hours,
+	COALESCE(user_email, ''), COALESCE(created_ip, ''), last_ip, version`
+
+func scanPlayer(row scanner, extra ...interface{}) (*Player, error) {
+	p := &Player{}
+	err := row.Scan(append([]interface{}{&p.ID, &p.Faction, &p.Race, &p.Class, &p.Profession1, &p.Profession2,
+		&p.WeeklyHours, &p.Owner, &p.CreatedIP, &p.LastIP, &p.Version}, extra...)...)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	return p, err
+}
+
+// GetPlayer gets the Player with the id.
+func GetPlayer(ctx context.Context, id int64) (*Player, error) {
+	return scanPlayer(db.Pool.QueryRowContext(ctx, `
+		SELECT `+playerColumns+`
 		FROM players
-		WHERE ip = ?;
-	`, ip).Scan(&p.Faction, &p.Race, &p.Class, &p.Profession1, &p.Profession2, p.WeeklyHours)
-	return
+		WHERE id = ?;
+	`, id))
 }
 
-// GetPlayers returns all players in the db.
-func GetPlayers(ctx context.Context) ([]*Player, error) {
+// GetPlayerByOwner gets the Player belonging to the user with the email.
+func GetPlayerByOwner(ctx context.Context, email string) (*Player, error) {
+	return scanPlayer(db.Pool.QueryRowContext(ctx, `
+		SELECT `+playerColumns+`
+		FROM players
+		WHERE user_email = ?;
+	`, email))
+}
+
+// GetPlayers returns a page of the players matching the query, the total number of matching
+// players, and the cursor for the next page, which is empty on the last page.
+func GetPlayers(ctx context.Context, q PlayerQuery) (players []*Player, total int, next string, err error) {
+	where, args := q.filters()
+
+	err = db.Pool.QueryRowContext(ctx, `
+		SELECT COUNT(*)
+		FROM players
+		`+where+`;
+	`, args...).Scan(&total)
+	if err != nil {
+		return
+	}
+
+	where, args, orderBy, err := q.page()
+	if err != nil {
+		return
+	}
+	sortExpr, _ := q.sortExpr()
+
+	limit := q.Limit
+	if limit <= 0 {
+		limit = DefaultPageSize
+	}
+
+	// one extra row is fetched to know if there is a next page
 	rows, err := db.Pool.QueryContext(ctx, `
-		SELECT ip, faction, race, class, profession1, profession2, weekly_hours
-		FROM players;
-	`)
+		SELECT `+playerColumns+`, `+sortExpr+`
+		FROM players
+		`+where+`
+		`+orderBy+`
+		LIMIT ?;
+	`, append(args, limit+1)...)
 	if err != nil {
-		return nil, err
+		return
 	}
 	defer rows.Close()
 
-	var players []*Player
+	var sortValue interface{}
 	for rows.Next() {
-		p := &Player{}
-		err = rows.Scan(&p.IP, &p.Faction, &p.Race, &p.Class, &p.Profession1, &p.Profession2, &p.WeeklyHours)
+		if len(players) == limit {
+			next, err = encodeCursor(cursor{Value: sortValue, ID: players[limit-1].ID})
+			return
+		}
+
+		p, err := scanPlayer(rows, &sortValue)
 		if err != nil {
-			return nil, err
+			return nil, 0, "", err
+		}
+		if b, ok := sortValue.([]byte); ok {
+			sortValue = string(b)
 		}
 		players = append(players, p)
 	}
 
-	return players, nil
+	return players, total, "", rows.Err()
 }
 
-// Save upserts the Player into the db.
+// Save upserts the Player belonging to its Owner into the db and sets its ID.
 func (p *Player) Save(ctx context.Context) error {
-	return db.Pool.MustAffect(ctx, `
-		INSERT INTO players (ip, race, class, profession1, profession2, weekly_hours)
-		VALUES (?, ?, ?, ?, ?, ?)
-		ON DUPLICATE KEY UPDATE players ip = ?, race = ?, class = ?, profession1 = ?,
-			profession2 = ?, weekly_hours = ?
-	`, p.IP, p.Race, p.Class, p.Profession1, p.Profession2, p.WeeklyHours, p.IP, p.Race,
-		p.Class, p.Profession1, p.Profession2, p.WeeklyHours)
+	res, err := db.Pool.ExecContext(ctx, `
+		INSERT INTO players (user_email, created_ip, last_ip, race, class, profession1, profession2, weekly_hours)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE id = LAST_INSERT_ID(id), last_ip = ?, race = ?, class = ?,
+			profession1 = ?, profession2 = ?, weekly_hours = ?, version = version + 1;
+	`, p.Owner, p.LastIP, p.LastIP, p.Race, p.Class, p.Profession1, p.Profession2, p.WeeklyHours,
+		p.LastIP, p.Race, p.Class, p.Profession1, p.Profession2, p.WeeklyHours)
+	if err != nil {
+		return err
+	}
+	p.ID, err = res.LastInsertId()
+	return err
+}
+
+// Update replaces the stored Player, as long as it is still at the given version. A version of 0
+// updates the Player regardless.
+func (p *Player) Update(ctx context.Context, version int) error {
+	err := db.Pool.MustAffect(ctx, `
+		UPDATE players
+		SET last_ip = ?, race = ?, class = ?, profession1 = ?, profession2 = ?, weekly_hours = ?,
+			version = version + 1
+		WHERE id = ? AND (? = 0 OR version = ?);
+	`, p.LastIP, p.Race, p.Class, p.Profession1, p.Profession2, p.WeeklyHours, p.ID, version, version)
+	if err == db.ErrNoEffect {
+		return missingOrChanged(ctx, p.ID)
+	}
+	return err
+}
+
+// DeletePlayer deletes the Player with the id, as long as it is still at the given version.
+// A version of 0 deletes the Player regardless.
+func DeletePlayer(ctx context.Context, id int64, version int) error {
+	err := db.Pool.MustAffect(ctx, `
+		DELETE FROM players
+		WHERE id = ? AND (? = 0 OR version = ?);
+	`, id, version, version)
+	if err == db.ErrNoEffect {
+		return missingOrChanged(ctx, id)
+	}
+	return err
+}
+
+// missingOrChanged explains why a conditional statement on a player affected no rows.
+func missingOrChanged(ctx context.Context, id int64) error {
+	if _, err := GetPlayer(ctx, id); err != nil {
+		return err
+	}
+	return ErrVersionMismatch
 }
@@ -0,0 +1,152 @@
+package models
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// DefaultPageSize is used when a query has no limit.
+const DefaultPageSize = 50
+
+// ErrBadCursor is returned when a pagination cursor cannot be decoded.
+var ErrBadCursor = errors.New("invalid cursor")
+
+type (
+	// PlayerQuery filters, sorts and paginates players. Multiple values for a filter match any of
+	// them, and Profession matches either of a player's professions.
+	PlayerQuery struct {
+		Faction        []string `json:"faction" validate:"dive,oneof=H A"`
+		Race           []string `json:"race" validate:"dive,oneof=dwarf gnome human 'night elf' orc tauren troll undead"`
+		Class          []string `json:"class" validate:"dive,oneof=druid hunter mage paladin priest rogue shaman warlock warrior"`
+		Profession     []string `json:"profession" validate:"dive,oneof=alchemy blacksmithing enchanting engineering herbalism mining tailoring"`
+		MinWeeklyHours *int     `json:"minWeeklyHours" validate:"omitempty,gt=0,lt=51"`
+		MaxWeeklyHours *int     `json:"maxWeeklyHours" validate:"omitempty,gt=0,lt=51"`
+		// Sort is the json name of the column to sort by, prefixed with "-" for descending order.
+		Sort   string `json:"sort" validate:"omitempty,oneof=id -id faction -faction race -race class -class profession1 -profession1 profession2 -profession2 weeklyHours -weeklyHours"`
+		Limit  int    `json:"limit" validate:"omitempty,min=1,max=200"`
+		Cursor string `json:"cursor"`
+	}
+
+	// cursor is the position of the last row of a page.
+	cursor struct {
+		Value interface{} `json:"v"`
+		ID    int64       `json:"id"`
+	}
+)
+
+// sortColumns maps the sortable json names to SQL expressions. Nullable columns are coalesced so
+// that rows can be compared with the cursor, and enums are compared as strings.
+var sortColumns = map[string]string{
+	"id":          "id",
+	"faction":     "CAST(faction AS CHAR)",
+	"race":        "CAST(race AS CHAR)",
+	"class":       "CAST(class AS CHAR)",
+	"profession1": "COALESCE(profession1, '')",
+	"profession2": "COALESCE(profession2, '')",
+	"weeklyHours": "COALESCE(weekly_hours, 0)",
+}
+
+// filters returns the WHERE clause and its args for the query's filters.
+func (q PlayerQuery) filters() (string, []interface{}) {
+	var where string
+	var args []interface{}
+
+	in := func(column string, values []string) {
+		if len(values) == 0 {
+			return
+		}
+		where = addCondition(where, column+" IN ("+placeholders(len(values))+")")
+		for _, v := range values {
+			args = append(args, v)
+		}
+	}
+	in("faction", q.Faction)
+	in("race", q.Race)
+	in("class", q.Class)
+
+	if len(q.Profession) != 0 {
+		ph := placeholders(len(q.Profession))
+		where = addCondition(where, "(profession1 IN ("+ph+") OR profession2 IN ("+ph+"))")
+		for i := 0; i < 2; i++ {
+			for _, v := range q.Profession {
+				args = append(args, v)
+			}
+		}
+	}
+
+	if q.MinWeeklyHours != nil {
+		where = addCondition(where, "weekly_hours >= ?")
+		args = append(args, *q.MinWeeklyHours)
+	}
+	if q.MaxWeeklyHours != nil {
+		where = addCondition(where, "weekly_hours <= ?")
+		args = append(args, *q.MaxWeeklyHours)
+	}
+
+	return where, args
+}
+
+// sortExpr returns the SQL expression to sort by and whether the order is descending.
+func (q PlayerQuery) sortExpr() (string, bool) {
+	desc := strings.HasPrefix(q.Sort, "-")
+	if expr, ok := sortColumns[strings.TrimPrefix(q.Sort, "-")]; ok {
+		return expr, desc
+	}
+	return sortColumns["id"], desc
+}
+
+// page returns the WHERE clause and its args for the rows after the query's cursor, and the
+// ORDER BY clause. Rows are ordered by id after the sort column, so that the order is total.
+func (q PlayerQuery) page() (where string, args []interface{}, orderBy string, err error) {
+	where, args = q.filters()
+
+	sortExpr, desc := q.sortExpr()
+	cmp, dir := ">", "ASC"
+	if desc {
+		cmp, dir = "<", "DESC"
+	}
+
+	if q.Cursor != "" {
+		var c cursor
+		if c, err = decodeCursor(q.Cursor); err != nil {
+			return "", nil, "", err
+		}
+		where = addCondition(where, fmt.Sprintf("(%[1]s %[2]s ? OR (%[1]s = ? AND id %[2]s ?))", sortExpr, cmp))
+		args = append(args, c.Value, c.Value, c.ID)
+	}
+
+	return where, args, "ORDER BY " + sortExpr + " " + dir + ", id " + dir, nil
+}
+
+func addCondition(where, condition string) string {
+	if where == "" {
+		return "WHERE " + condition
+	}
+	return where + " AND " + condition
+}
+
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
+func encodeCursor(c cursor) (string, error) {
+	b, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func decodeCursor(s string) (c cursor, err error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, ErrBadCursor
+	}
+	if err = json.Unmarshal(b, &c); err != nil || c.ID == 0 {
+		return c, ErrBadCursor
+	}
+	return c, nil
+}
@@ -0,0 +1,143 @@
+package models
+
+import (
+	"reflect"
+	"testing"
+)
+
+func intPtr(i int) *int {
+	return &i
+}
+
+func TestFilters(t *testing.T) {
+	cases := []struct {
+		name  string
+		q     PlayerQuery
+		where string
+		args  []interface{}
+	}{
+		{"none", PlayerQuery{}, "", nil},
+		{"faction", PlayerQuery{Faction: []string{"H"}}, "WHERE faction IN (?)", []interface{}{"H"}},
+		{"race", PlayerQuery{Race: []string{"orc", "night elf"}}, "WHERE race IN (?, ?)", []interface{}{"orc", "night elf"}},
+		{"class", PlayerQuery{Class: []string{"mage"}}, "WHERE class IN (?)", []interface{}{"mage"}},
+		{
+			"profession", PlayerQuery{Profession: []string{"mining", "herbalism"}},
+			"WHERE (profession1 IN (?, ?) OR profession2 IN (?, ?))",
+			[]interface{}{"mining", "herbalism", "mining", "herbalism"},
+		},
+		{"min hours", PlayerQuery{MinWeeklyHours: intPtr(5)}, "WHERE weekly_hours >= ?", []interface{}{5}},
+		{"max hours", PlayerQuery{MaxWeeklyHours: intPtr(20)}, "WHERE weekly_hours <= ?", []interface{}{20}},
+		{
+			"combined", PlayerQuery{Faction: []string{"A"}, Class: []string{"rogue"}, MinWeeklyHours: intPtr(1), MaxWeeklyHours: intPtr(50)},
+			"WHERE faction IN (?) AND class IN (?) AND weekly_hours >= ? AND weekly_hours <= ?",
+			[]interface{}{"A", "rogue", 1, 50},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			where, args := tc.q.filters()
+			if where != tc.where {
+				t.Fatalf("got %q; want %q", where, tc.where)
+			}
+			if !reflect.DeepEqual(args, tc.args) {
+				t.Fatalf("got args %v; want %v", args, tc.args)
+			}
+		})
+	}
+}
+
+func TestSortExpr(t *testing.T) {
+	cases := []struct {
+		sort string
+		expr string
+		desc bool
+	}{
+		{"", "id", false},
+		{"-id", "id", true},
+		{"race", "CAST(race AS CHAR)", false},
+		{"-weeklyHours", "COALESCE(weekly_hours, 0)", true},
+		{"profession2", "COALESCE(profession2, '')", false},
+		// columns that can't be sorted by fall back to id rather than reaching the SQL
+		{"weekly_hours; DROP TABLE players", "id", false},
+		{"-password", "id", true},
+	}
+
+	for _, tc := range cases {
+		expr, desc := PlayerQuery{Sort: tc.sort}.sortExpr()
+		if expr != tc.expr || desc != tc.desc {
+			t.Errorf("%q: got %q, %v; want %q, %v", tc.sort, expr, desc, tc.expr, tc.desc)
+		}
+	}
+}
+
+func TestPage(t *testing.T) {
+	after, err := encodeCursor(cursor{Value: "orc", ID: 7})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name    string
+		q       PlayerQuery
+		where   string
+		args    []interface{}
+		orderBy string
+	}{
+		{"first page", PlayerQuery{}, "", nil, "ORDER BY id ASC, id ASC"},
+		{
+			"after cursor", PlayerQuery{Sort: "race", Cursor: after},
+			"WHERE (CAST(race AS CHAR) > ? OR (CAST(race AS CHAR) = ? AND id > ?))",
+			[]interface{}{"orc", "orc", int64(7)},
+			"ORDER BY CAST(race AS CHAR) ASC, id ASC",
+		},
+		{
+			"descending with filter", PlayerQuery{Faction: []string{"H"}, Sort: "-race", Cursor: after},
+			"WHERE faction IN (?) AND (CAST(race AS CHAR) < ? OR (CAST(race AS CHAR) = ? AND id < ?))",
+			[]interface{}{"H", "orc", "orc", int64(7)},
+			"ORDER BY CAST(race AS CHAR) DESC, id DESC",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			where, args, orderBy, err := tc.q.page()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if where != tc.where || orderBy != tc.orderBy {
+				t.Fatalf("got %q %q; want %q %q", where, orderBy, tc.where, tc.orderBy)
+			}
+			if !reflect.DeepEqual(args, tc.args) {
+				t.Fatalf("got args %#v; want %#v", args, tc.args)
+			}
+		})
+	}
+}
+
+func TestCursor(t *testing.T) {
+	for _, c := range []cursor{{Value: "night elf", ID: 3}, {Value: float64(12), ID: 1 << 40}} {
+		s, err := encodeCursor(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := decodeCursor(s)
+		if err != nil || !reflect.DeepEqual(got, c) {
+			t.Fatalf("got %v, %v; want %v", got, err, c)
+		}
+	}
+
+	for _, s := range []string{
+		"not base64!",
+		"bm90IGpzb24",    // "not json"
+		"eyJ2IjoxfQ",     // {"v":1}, without an id
+		"eyJpZCI6ImEifQ", // {"id":"a"}
+	} {
+		if _, err := decodeCursor(s); err != ErrBadCursor {
+			t.Errorf("%q: got %v; want %v", s, err, ErrBadCursor)
+		}
+		if _, _, _, err := (PlayerQuery{Cursor: s}).page(); err != ErrBadCursor {
+			t.Errorf("%q: got %v from page; want %v", s, err, ErrBadCursor)
+		}
+	}
+}
@@ -1,102 +1,611 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"log"
+	"mime"
 	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 )
 
 type (
 	methodRouter struct {
-		get    http.HandlerFunc
-		put    http.HandlerFunc
-		post   http.HandlerFunc
-		delete http.HandlerFunc
+		get     http.HandlerFunc
+		head    http.HandlerFunc
+		put     http.HandlerFunc
+		post    http.HandlerFunc
+		patch   http.HandlerFunc
+		delete  http.HandlerFunc
+		options http.HandlerFunc
+	}
+
+	// segment is a single '/' separated piece of a route pattern.
+	segment struct {
+		// name is the literal text to match, or the param name for params and wildcards.
+		name     string
+		param    bool
+		wildcard bool
+	}
+
+	route struct {
+		pattern  string
+		segments []segment
+		methods  *methodRouter
+	}
+
+	// middleware wraps a handler with extra behaviour. It can stop the request by not calling
+	// the next handler, or wrap the ResponseWriter before passing it along.
+	middleware func(http.Handler) http.Handler
+
+	// group is a set of middleware applied to every request whose path matches the pattern.
+	group struct {
+		segments   []segment
+		middleware []middleware
+	}
+
+	// mount is a sub-router serving every request under prefix.
+	mount struct {
+		prefix []string
+		sub    *mux
 	}
 
 	mux struct {
-		*http.ServeMux
-		middleware []http.HandlerFunc
-		routes     map[string]methodRouter
+		middleware []middleware
+		groups     []group
+		routes     []*route
+		mounts     []mount
+		versions   map[string]*mux
 	}
+
+	paramsKey struct{}
 )
 
-func newMux(middleware ...http.HandlerFunc) *mux {
+func newMux(middleware ...middleware) *mux {
 	return &mux{
-		ServeMux:   http.NewServeMux(),
 		middleware: middleware,
-		routes:     map[string]methodRouter{},
 	}
 }
 
-var invalidMethod = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-	w.WriteHeader(http.StatusMethodNotAllowed)
-})
+// parsePattern splits a route pattern into segments. Patterns are made of literal segments,
+// named params like "{ip}" that match exactly one segment, and an optional final wildcard,
+// either "*" or "{name*}", that matches the rest of the path. A trailing slash on the pattern
+// is ignored, so "/players" and "/players/" are the same route.
+func parsePattern(pattern string) []segment {
+	if !strings.HasPrefix(pattern, "/") {
+		panic("mux: pattern must begin with '/': " + pattern)
+	}
+
+	parts := splitPath(pattern)
+	segments := make([]segment, len(parts))
+	for i, p := range parts {
+		switch {
+		case p == "*":
+			segments[i] = segment{name: "*", wildcard: true}
+		case strings.HasPrefix(p, "{") && strings.HasSuffix(p, "}"):
+			name := p[1 : len(p)-1]
+			s := segment{name: name, param: true}
+			if strings.HasSuffix(name, "*") {
+				s = segment{name: strings.TrimSuffix(name, "*"), wildcard: true}
+			}
+			if s.name == "" {
+				panic("mux: empty param name in pattern: " + pattern)
+			}
+			segments[i] = s
+		default:
+			segments[i] = segment{name: p}
+		}
+		if segments[i].wildcard && i != len(parts)-1 {
+			panic("mux: wildcard must be the last segment of pattern: " + pattern)
+		}
+	}
+	return segments
+}
+
+// splitPath trims the leading and trailing slashes from path and splits it on the rest.
+func splitPath(path string) []string {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return nil
+	}
+	return strings.Split(path, "/")
+}
 
-func (m *mux) post(route string, handler http.HandlerFunc) {
-	if r, ok := m.routes[route]; ok {
-		r.post = handler
-	} else {
-		m.routes[route] = methodRouter{post: handler}
+// match checks the escaped path segments against the pattern segments and returns the captured
+// params.
+func match(segments []segment, parts []string) (map[string]string, bool) {
+	params := map[string]string{}
+	for i, s := range segments {
+		if s.wildcard {
+			rest, err := url.PathUnescape(strings.Join(parts[i:], "/"))
+			if err != nil {
+				return nil, false
+			}
+			params[s.name] = rest
+			return params, true
+		}
+		if i >= len(parts) {
+			return nil, false
+		}
+		part, err := url.PathUnescape(parts[i])
+		if err != nil {
+			return nil, false
+		}
+		if s.param {
+			if part == "" {
+				return nil, false
+			}
+			params[s.name] = part
+		} else if s.name != part {
+			return nil, false
+		}
+	}
+	if len(parts) != len(segments) {
+		return nil, false
 	}
+	return params, true
 }
 
-func (m *mux) get(route string, handler http.HandlerFunc) {
-	if r, ok := m.routes[route]; ok {
-		r.get = handler
-	} else {
-		m.routes[route] = methodRouter{get: handler}
+// moreSpecific reports whether rt should take precedence over other when both match a path.
+// Literal segments beat params, which beat wildcards.
+func (rt *route) moreSpecific(other *route) bool {
+	for i := 0; i < len(rt.segments) && i < len(other.segments); i++ {
+		a, b := rt.segments[i].rank(), other.segments[i].rank()
+		if a != b {
+			return a < b
+		}
 	}
+	return len(rt.segments) > len(other.segments)
 }
 
-func (m *mux) put(route string, handler http.HandlerFunc) {
-	if r, ok := m.routes[route]; ok {
-		r.put = handler
-	} else {
-		m.routes[route] = methodRouter{put: handler}
+func (s segment) rank() int {
+	switch {
+	case s.wildcard:
+		return 2
+	case s.param:
+		return 1
 	}
+	return 0
 }
 
-func (m *mux) delete(route string, handler http.HandlerFunc) {
-	if r, ok := m.routes[route]; ok {
-		r.delete = handler
-	} else {
-		m.routes[route] = methodRouter{delete: handler}
+// sameShape reports whether both segment lists match exactly the same paths.
+func sameShape(a, b []segment) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].rank() != b[i].rank() || (a[i].rank() == 0 && a[i].name != b[i].name) {
+			return false
+		}
 	}
+	return true
 }
 
-func (m *mux) ListenAndServe(addr string) error {
-	for k, v := range m.routes {
-		// all unassigned request methods should return status 405
-		for _, h := range []*http.HandlerFunc{&v.get, &v.put, &v.post, &v.delete} {
-			if *h == nil {
-				*h = invalidMethod
+// methods returns the methodRouter for the pattern, creating the route if needed.
+func (m *mux) methods(pattern string) *methodRouter {
+	segments := parsePattern(pattern)
+	pattern = "/" + strings.Join(splitPath(pattern), "/")
+	for _, rt := range m.routes {
+		if sameShape(rt.segments, segments) {
+			if rt.pattern != pattern {
+				panic("mux: pattern " + pattern + " conflicts with " + rt.pattern)
+			}
+			return rt.methods
+		}
+	}
+	rt := &route{pattern: pattern, segments: segments, methods: &methodRouter{}}
+	m.routes = append(m.routes, rt)
+	return rt.methods
+}
+
+// chain wraps the handler so that the first middleware is the outermost.
+func chain(h http.Handler, middleware ...middleware) http.Handler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		h = middleware[i](h)
+	}
+	return h
+}
+
+// use attaches middleware to every request matching the pattern, e.g. "/admin/*". Group
+// middleware runs after the mux middleware and before any route middleware, including for
+// requests that do not match a route.
+func (m *mux) use(pattern string, middleware ...middleware) {
+	m.groups = append(m.groups, group{segments: parsePattern(pattern), middleware: middleware})
+}
+
+// mount serves every request under prefix with the sub-router. The prefix is stripped from the
+// path before it reaches sub, and takes precedence over routes registered on m under the same
+// prefix.
+func (m *mux) mount(prefix string, sub *mux) {
+	for _, s := range parsePattern(prefix) {
+		if s.param || s.wildcard {
+			panic("mux: mount prefix must be literal: " + prefix)
+		}
+	}
+	m.mounts = append(m.mounts, mount{prefix: splitPath(prefix), sub: sub})
+}
+
+// group creates a sub-router with its own middleware and route table and mounts it at prefix.
+func (m *mux) group(prefix string, middleware ...middleware) *mux {
+	sub := newMux(middleware...)
+	m.mount(prefix, sub)
+	return sub
+}
+
+// version creates a group mounted at "/api/<v>", e.g. "/api/v2". Requests outside of any
+// mount that accept "application/vnd.goproj.<v>+json" are also routed to it, without the
+// prefix being stripped.
+func (m *mux) version(v string, middleware ...middleware) *mux {
+	sub := m.group("/api/"+v, middleware...)
+	if m.versions == nil {
+		m.versions = map[string]*mux{}
+	}
+	m.versions[v] = sub
+	return sub
+}
+
+// acceptedVersion returns the first API version requested by a vendor media type in the
+// Accept header, if it has been registered.
+func (m *mux) acceptedVersion(r *http.Request) *mux {
+	const vendorPrefix = "application/vnd.goproj."
+
+	for _, accept := range r.Header.Values("Accept") {
+		for _, mediaRange := range strings.Split(accept, ",") {
+			mediaType, _, err := mime.ParseMediaType(mediaRange)
+			if err != nil || !strings.HasPrefix(mediaType, vendorPrefix) {
+				continue
+			}
+			v := strings.TrimSuffix(strings.TrimPrefix(mediaType, vendorPrefix), "+json")
+			if sub, ok := m.versions[v]; ok {
+				return sub
+			}
+		}
+	}
+	return nil
+}
+
+// lookupMount finds the mount with the longest prefix of the path and returns the request
+// with that prefix stripped.
+func (m *mux) lookupMount(r *http.Request) (*mux, *http.Request) {
+	parts := splitPath(r.URL.EscapedPath())
+
+	var best *mount
+	for i, mt := range m.mounts {
+		if len(mt.prefix) > len(parts) || (best != nil && len(mt.prefix) <= len(best.prefix)) {
+			continue
+		}
+		matched := true
+		for j, p := range mt.prefix {
+			if part, err := url.PathUnescape(parts[j]); err != nil || part != p {
+				matched = false
+				break
 			}
 		}
-		// assign each route to a methodRouter
-		m.HandleFunc(k, routeByMethod(k, v))
+		if matched {
+			best = &m.mounts[i]
+		}
 	}
-	return http.ListenAndServe(addr, m)
+	if best == nil {
+		return nil, r
+	}
+
+	r2 := new(http.Request)
+	*r2 = *r
+	r2.URL = new(url.URL)
+	*r2.URL = *r.URL
+	r2.URL.Path = stripSegments(r.URL.Path, len(best.prefix))
+	if r.URL.RawPath != "" {
+		r2.URL.RawPath = stripSegments(r.URL.RawPath, len(best.prefix))
+	}
+	return best.sub, r2
+}
+
+// requestPath returns the path requested by the client, including any prefix stripped by a mount.
+func requestPath(r *http.Request) string {
+	if path := strings.SplitN(r.RequestURI, "?", 2)[0]; path != "" {
+		return path
+	}
+	return r.URL.Path
+}
+
+// stripSegments removes the first n segments from the path.
+func stripSegments(path string, n int) string {
+	parts := splitPath(path)
+	if n > len(parts) {
+		n = len(parts)
+	}
+	return "/" + strings.Join(parts[n:], "/")
+}
+
+func (m *mux) post(route string, handler http.HandlerFunc, middleware ...middleware) {
+	m.methods(route).post = chain(handler, middleware...).ServeHTTP
+}
+
+func (m *mux) get(route string, handler http.HandlerFunc, middleware ...middleware) {
+	m.methods(route).get = chain(handler, middleware...).ServeHTTP
+}
+
+func (m *mux) put(route string, handler http.HandlerFunc, middleware ...middleware) {
+	m.methods(route).put = chain(handler, middleware...).ServeHTTP
+}
+
+func (m *mux) delete(route string, handler http.HandlerFunc, middleware ...middleware) {
+	m.methods(route).delete = chain(handler, middleware...).ServeHTTP
+}
+
+func (m *mux) patch(route string, handler http.HandlerFunc, middleware ...middleware) {
+	m.methods(route).patch = chain(handler, middleware...).ServeHTTP
+}
+
+// head overrides the HEAD handler that is otherwise derived from the route's GET handler.
+func (m *mux) head(route string, handler http.HandlerFunc, middleware ...middleware) {
+	m.methods(route).head = chain(handler, middleware...).ServeHTTP
+}
+
+// options overrides the default OPTIONS handler, which responds with the route's Allow header.
+func (m *mux) options(route string, handler http.HandlerFunc, middleware ...middleware) {
+	m.methods(route).options = chain(handler, middleware...).ServeHTTP
+}
+
+type serverConfig struct {
+	ReadTimeout       time.Duration
+	ReadHeaderTimeout time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	// ShutdownTimeout is how long in-flight requests get to finish after SIGINT or SIGTERM.
+	ShutdownTimeout time.Duration
+
+	// TLSCertFile and TLSKeyFile enable HTTPS when both are set.
+	TLSCertFile string
+	TLSKeyFile  string
+	// TLSSelfSigned enables HTTPS with a generated certificate when no cert files are set.
+	TLSSelfSigned bool
+	// RedirectAddr, if set while TLS is enabled, is the address of a plain HTTP listener that
+	// redirects every request to HTTPS.
+	RedirectAddr string
+}
+
+func serverConfigFromEnv() serverConfig {
+	cfg := serverConfig{
+		ReadTimeout:       envDuration("SERVER_READ_TIMEOUT", 15*time.Second),
+		ReadHeaderTimeout: envDuration("SERVER_READ_HEADER_TIMEOUT", 5*time.Second),
+		WriteTimeout:      envDuration("SERVER_WRITE_TIMEOUT", 30*time.Second),
+		IdleTimeout:       envDuration("SERVER_IDLE_TIMEOUT", 2*time.Minute),
+		ShutdownTimeout:   envDuration("SERVER_SHUTDOWN_TIMEOUT", 20*time.Second),
+		TLSCertFile:       os.Getenv("TLS_CERT_FILE"),
+		TLSKeyFile:        os.Getenv("TLS_KEY_FILE"),
+		TLSSelfSigned:     envBool("TLS_SELF_SIGNED", false),
+	}
+	// one without the other would silently serve plain HTTP, or fail to start when self-signed
+	if (cfg.TLSCertFile == "") != (cfg.TLSKeyFile == "") {
+		log.Fatal("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	if port := os.Getenv("TLS_REDIRECT_PORT"); port != "" {
+		cfg.RedirectAddr = ":" + port
+	}
+	return cfg
+}
+
+func (cfg serverConfig) tlsEnabled() bool {
+	return (cfg.TLSCertFile != "" && cfg.TLSKeyFile != "") || cfg.TLSSelfSigned
+}
+
+// ListenAndServe serves the mux until the server fails or the process receives SIGINT or SIGTERM,
+// in which case it stops accepting connections and waits up to cfg.ShutdownTimeout for in-flight
+// requests to finish. It returns nil after a clean shutdown.
+func (m *mux) ListenAndServe(addr string, cfg serverConfig) error {
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           m,
+		ReadTimeout:       cfg.ReadTimeout,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+	}
+	servers := []*http.Server{srv}
+	listen := srv.ListenAndServe
+
+	if cfg.tlsEnabled() {
+		srv.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+		if cfg.TLSCertFile == "" || cfg.TLSKeyFile == "" {
+			log.Println("Using a self-signed certificate...")
+			cert, err := selfSignedCert("localhost", "127.0.0.1", "::1")
+			if err != nil {
+				return err
+			}
+			srv.TLSConfig.Certificates = []tls.Certificate{cert}
+		}
+		listen = func() error {
+			return srv.ListenAndServeTLS(cfg.TLSCertFile, cfg.TLSKeyFile)
+		}
+
+		if cfg.RedirectAddr != "" {
+			servers = append(servers, &http.Server{
+				Addr:              cfg.RedirectAddr,
+				Handler:           redirectToHTTPS(addr),
+				ReadTimeout:       cfg.ReadTimeout,
+				ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+				WriteTimeout:      cfg.WriteTimeout,
+				IdleTimeout:       cfg.IdleTimeout,
+			})
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	errs := make(chan error, len(servers))
+	go func() {
+		errs <- listen()
+	}()
+	for _, s := range servers[1:] {
+		go func(s *http.Server) {
+			errs <- s.ListenAndServe()
+		}(s)
+	}
+
+	select {
+	case err := <-errs:
+		for _, s := range servers {
+			s.Close()
+		}
+		return err
+	case <-ctx.Done():
+	}
+	// a second signal kills the process without waiting
+	stop()
+
+	log.Println("Shutting down server...")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+
+	var shutdownErr error
+	for _, s := range servers {
+		if err := s.Shutdown(shutdownCtx); err != nil && shutdownErr == nil {
+			shutdownErr = err
+		}
+	}
+	for range servers {
+		if err := <-errs; err != http.ErrServerClosed && shutdownErr == nil {
+			shutdownErr = err
+		}
+	}
+	return shutdownErr
 }
 
 func (m *mux) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	for _, mw := range m.middleware {
-		mw(w, r)
+	var h http.Handler = http.HandlerFunc(m.route)
+
+	parts := splitPath(r.URL.EscapedPath())
+	for i := len(m.groups) - 1; i >= 0; i-- {
+		g := m.groups[i]
+		if _, ok := match(g.segments, parts); ok {
+			h = chain(h, g.middleware...)
+		}
 	}
-	m.ServeMux.ServeHTTP(w, r)
+
+	chain(h, m.middleware...).ServeHTTP(w, r)
 }
 
-func routeByMethod(route string, router methodRouter) http.HandlerFunc {
+// route dispatches the request to the matching mount, or to the matching route's methodRouter.
+func (m *mux) route(w http.ResponseWriter, r *http.Request) {
+	if sub, r := m.lookupMount(r); sub != nil {
+		sub.ServeHTTP(w, r)
+		return
+	}
+
+	if len(m.versions) != 0 {
+		w.Header().Add("Vary", "Accept")
+		// routes the version doesn't have, like /login, are still served by m
+		if sub := m.acceptedVersion(r); sub != nil && sub.handles(r) {
+			sub.ServeHTTP(w, r)
+			return
+		}
+	}
+
+	rt, params := m.lookup(r.URL.EscapedPath())
+	if rt == nil {
+		httpErr(w, r, http.StatusNotFound, nil)
+		return
+	}
+
+	ctx := context.WithValue(r.Context(), paramsKey{}, params)
+	routeByMethod(*rt.methods)(w, r.WithContext(ctx))
+}
+
+// handles reports whether a route or mount of m matches the request path.
+func (m *mux) handles(r *http.Request) bool {
+	if sub, r := m.lookupMount(r); sub != nil {
+		return sub.handles(r)
+	}
+	rt, _ := m.lookup(r.URL.EscapedPath())
+	return rt != nil
+}
+
+// lookup finds the most specific route matching the path.
+func (m *mux) lookup(path string) (*route, map[string]string) {
+	parts := splitPath(path)
+
+	var best *route
+	var bestParams map[string]string
+	for _, rt := range m.routes {
+		if params, ok := match(rt.segments, parts); ok && (best == nil || rt.moreSpecific(best)) {
+			best, bestParams = rt, params
+		}
+	}
+	return best, bestParams
+}
+
+// pathParam returns the value captured by the named param or wildcard of the matched route,
+// or an empty string if there is no such param. Unnamed wildcards are stored as "*".
+func pathParam(r *http.Request, name string) string {
+	params, _ := r.Context().Value(paramsKey{}).(map[string]string)
+	return params[name]
+}
+
+// allowed returns the methods the router responds to, for use in the Allow header.
+func (router methodRouter) allowed() string {
+	var methods []string
+	for _, m := range []struct {
+		name    string
+		handler http.HandlerFunc
+	}{
+		{http.MethodGet, router.get},
+		{http.MethodHead, router.head},
+		{http.MethodPost, router.post},
+		{http.MethodPut, router.put},
+		{http.MethodPatch, router.patch},
+		{http.MethodDelete, router.delete},
+	} {
+		if m.handler != nil || (m.name == http.MethodHead && router.get != nil) {
+			methods = append(methods, m.name)
+		}
+	}
+	return strings.Join(append(methods, http.MethodOptions), ", ")
+}
+
+func routeByMethod(router methodRouter) http.HandlerFunc {
+	// HEAD falls back to GET; net/http discards the body written for HEAD requests
+	if router.head == nil {
+		router.head = router.get
+	}
+	if router.options == nil {
+		router.options = func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Allow", router.allowed())
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}
+
 	return func(w http.ResponseWriter, r *http.Request) {
+		var h http.HandlerFunc
 		switch r.Method {
-		case "GET":
-			router.get(w, r)
-		case "PUT":
-			router.put(w, r)
-		case "POST":
-			router.post(w, r)
-		case "DELETE":
-			router.delete(w, r)
-		default:
-			w.WriteHeader(http.StatusMethodNotAllowed)
+		case http.MethodGet:
+			h = router.get
+		case http.MethodHead:
+			h = router.head
+		case http.MethodPut:
+			h = router.put
+		case http.MethodPost:
+			h = router.post
+		case http.MethodPatch:
+			h = router.patch
+		case http.MethodDelete:
+			h = router.delete
+		case http.MethodOptions:
+			h = router.options
+		}
+
+		// all unassigned request methods should return status 405
+		if h == nil {
+			w.Header().Set("Allow", router.allowed())
+			httpErr(w, r, http.StatusMethodNotAllowed, nil)
+			return
 		}
+		h(w, r)
 	}
 }
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+
+	"github.com/calvinsomething/go-proj/auth"
+)
+
+type (
+	forgotPassword struct {
+		Email string `json:"email" validate:"email"`
+	}
+
+	resetPassword struct {
+		Token    string `json:"token" validate:"required"`
+		Password string `json:"password" validate:"min=8,max=20,password"`
+	}
+)
+
+// passwordResetURL is the client page that password reset links open, with the token in the query.
+var passwordResetURL string
+
+// passwordRoutes registers the password reset routes.
+func passwordRoutes(m *mux) {
+	m.post("/password/forgot", forgotPasswordHandler)
+	m.post("/password/reset", resetPasswordHandler)
+}
+
+// forgotPasswordHandler emails a password reset link, at most once every PasswordResetInterval. It
+// responds the same whether or not there is a user with the email, or one was sent too recently, so
+// that it can't be used to find users.
+func forgotPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	var body forgotPassword
+	if err := decodeBody(r, &body); err != nil {
+		decodeErr(w, r, err)
+		return
+	}
+
+	if err := validate.Struct(&body); err != nil {
+		validationErr(w, r, err)
+		return
+	}
+
+	token, err := auth.PasswordResetToken(r.Context(), body.Email)
+	if err == nil {
+		err = sendMail(r, body.Email, "reset", linkMail{
+			Link:  passwordResetURL + "?token=" + url.QueryEscape(token),
+			Hours: hours(auth.PasswordResetTTL),
+		})
+	}
+	if err != nil && err != auth.ErrNoReset {
+		log.Println("UNHANDLED:", err)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// resetPasswordHandler sets a new password with a token from a password reset email, logging the
+// user out everywhere.
+func resetPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	var body resetPassword
+	if err := decodeBody(r, &body); err != nil {
+		decodeErr(w, r, err)
+		return
+	}
+
+	if err := validate.Struct(&body); err != nil {
+		validationErr(w, r, err)
+		return
+	}
+
+	err := auth.ResetPassword(r.Context(), body.Token, body.Password)
+	switch err {
+	case nil:
+		expireSessionCookie(w, r)
+		w.WriteHeader(http.StatusNoContent)
+	case auth.ErrBadToken, auth.ErrTokenExpired:
+		httpErr(w, r, 400, err)
+	default:
+		httpErr(w, r, 500, err)
+	}
+}
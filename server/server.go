@@ -1,20 +1,26 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
 	"log"
+	"math"
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/go-playground/validator/v10"
 
 	"github.com/calvinsomething/go-proj/auth"
 	"github.com/calvinsomething/go-proj/db"
+	"github.com/calvinsomething/go-proj/mail"
 )
 
 var (
 	hostPort string
+	// publicURL is where clients reach the server, for links in emails
+	publicURL string
 
 	validate *validator.Validate
 )
@@ -23,26 +29,110 @@ func main() {
 	log.SetFlags(log.Ldate | log.Ltime | log.Lshortfile)
 
 	hostPort = os.Getenv("SERVER_PORT")
+	publicURL = strings.TrimSuffix(envString("PUBLIC_URL", "http://localhost:"+hostPort), "/")
+	passwordResetURL = envString("PASSWORD_RESET_URL", "http://localhost:"+os.Getenv("CLIENT_PORT")+"/reset-password")
+	trustedProxies = parseTrustedProxies(envList("TRUSTED_PROXIES"))
+	auth.SessionIdleTimeout = envDuration("SESSION_IDLE_TIMEOUT", auth.SessionIdleTimeout)
+	auth.SessionLifetime = envDuration("SESSION_LIFETIME", auth.SessionLifetime)
+	auth.SessionTouchInterval = envDuration("SESSION_TOUCH_INTERVAL", auth.SessionTouchInterval)
+	auth.Store = sessionStoreFromEnv()
+	auth.VerificationTTL = envDuration("VERIFICATION_TTL", auth.VerificationTTL)
+	auth.VerificationResendInterval = envDuration("VERIFICATION_RESEND_INTERVAL", auth.VerificationResendInterval)
+	auth.PasswordResetTTL = envDuration("PASSWORD_RESET_TTL", auth.PasswordResetTTL)
+	auth.PasswordResetInterval = envDuration("PASSWORD_RESET_INTERVAL", auth.PasswordResetInterval)
+	auth.LockoutThreshold = envInt("LOGIN_LOCKOUT_THRESHOLD", auth.LockoutThreshold)
+	auth.LockoutBase = envDuration("LOGIN_LOCKOUT_BASE", auth.LockoutBase)
+	auth.LockoutMax = envDuration("LOGIN_LOCKOUT_MAX", auth.LockoutMax)
+	argon := &auth.PasswordParams
+	argon.Memory = uint32(envUint("PASSWORD_ARGON2_MEMORY", uint64(argon.Memory), math.MaxUint32))
+	argon.Iterations = uint32(envUint("PASSWORD_ARGON2_ITERATIONS", uint64(argon.Iterations), math.MaxUint32))
+	argon.Parallelism = uint8(envUint("PASSWORD_ARGON2_PARALLELISM", uint64(argon.Parallelism), math.MaxUint8))
 
 	db.Initialize(os.Getenv("DB_USER"), os.Getenv("DB_PASSWORD"), os.Getenv("DB_PORT"), os.Getenv("DB_NAME"))
-	defer db.Pool.Close()
 
 	execArgs()
-	validate = validator.New()
-	validate.RegisterValidation("password", auth.PasswordValidator)
+	setSessionKeys()
 
-	middleware := []http.HandlerFunc{
-		logger,
+	mailFrom = envString("MAIL_FROM", "go-proj <noreply@localhost>")
+	templates, err := mail.DefaultTemplates()
+	if err != nil {
+		log.Fatal(err)
 	}
-	m := newMux(middleware...)
+	mailTemplates = templates
+	queue := mailQueueFromEnv()
+	mailer = queue
+	validate = newValidator()
+
+	m := newMux(requestID, logger, cors(corsConfigFromEnv()), authenticate)
 
-	m.get("/players", getPlayersHandler)
-	m.post("/player", addPlayerHandler)
 	m.post("/login", loginHandler)
+	m.post("/logout", logoutHandler)
 	m.post("/register", registerHandler)
+	verifyRoutes(m)
+	passwordRoutes(m)
+
+	// the unversioned routes are kept for the current client and are the same as v1
+	v1 := m.version("v1")
+	for _, r := range []*mux{m, v1} {
+		playerRoutes(r)
+		me := r.group("/me", requireUser)
+		characterRoutes(me)
+		sessionRoutes(me)
+	}
+
+	purgeInterval := envDuration("SESSION_PURGE_INTERVAL", time.Hour)
+	if purgeInterval <= 0 {
+		log.Fatalf("Invalid duration for SESSION_PURGE_INTERVAL: %s is not positive", purgeInterval)
+	}
+	purgeCtx, stopPurging := context.WithCancel(context.Background())
+	purgeDone := make(chan struct{})
+	go func() {
+		defer close(purgeDone)
+		purgeSessions(purgeCtx, purgeInterval)
+	}()
 
 	log.Printf("Listening on port %s...\n", hostPort)
-	log.Fatal(m.ListenAndServe(":" + hostPort))
+	cfg := serverConfigFromEnv()
+	err = m.ListenAndServe(":"+hostPort, cfg)
+	// a purge may be mid-query, so it has to finish before the pool is closed
+	stopPurging()
+	<-purgeDone
+
+	// the pool is only closed once the server has stopped handling requests
+	if closeErr := db.Pool.Close(); closeErr != nil {
+		log.Println(closeErr)
+	}
+
+	// queued mail gets as long to send as requests got to finish
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	if closeErr := queue.Close(ctx); closeErr != nil {
+		log.Println("Mail queue not drained:", closeErr)
+	}
+	cancel()
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Println("Server stopped")
+}
+
+func newValidator() *validator.Validate {
+	v := validator.New()
+	v.RegisterTagNameFunc(jsonFieldName)
+	v.RegisterValidation("password", auth.PasswordValidator)
+	if err := registerTranslations(v); err != nil {
+		log.Fatal(err)
+	}
+	return v
+}
+
+// playerRoutes registers the player routes, where only reading players is public.
+func playerRoutes(m *mux) {
+	m.get("/players", getPlayersHandler)
+	m.post("/player", addPlayerHandler, requireUser)
+	m.get("/players/{id}", getPlayerHandler)
+	m.put("/players/{id}", replacePlayerHandler, requireUser)
+	m.patch("/players/{id}", patchPlayerHandler, requireUser)
+	m.delete("/players/{id}", deletePlayerHandler, requireUser)
 }
 
 func execArgs() {
@@ -75,6 +165,52 @@ func execArgs() {
 			} else {
 				log.Fatal("Missing migrate option")
 			}
+		case "unlock":
+			shouldExit = true
+			i++
+			if len(os.Args) <= i {
+				log.Fatal("Missing email to unlock")
+			}
+			err := auth.Unlock(context.Background(), os.Args[i])
+			if err == db.ErrNoEffect {
+				log.Printf("%s is not locked", os.Args[i])
+			} else if err != nil {
+				log.Fatal(err)
+			} else {
+				log.Printf("Unlocked %s", os.Args[i])
+			}
+		case "keys":
+			shouldExit = true
+			i++
+			if len(os.Args) <= i {
+				log.Fatal("Missing keys option")
+			}
+			switch os.Args[i] {
+			case "generate":
+				k, err := auth.GenerateKey()
+				if err != nil {
+					log.Fatal(err)
+				}
+				if err = auth.WriteKeys(os.Stdout, []auth.Key{k}); err != nil {
+					log.Fatal(err)
+				}
+			case "rotate":
+				path := envString("SESSION_KEY_FILE", "")
+				if len(os.Args) > i+1 {
+					i++
+					path = os.Args[i]
+				}
+				if path == "" {
+					log.Fatal("Missing key file, set SESSION_KEY_FILE or pass its path")
+				}
+				k, err := auth.RotateKeyFile(path, previousSessionKeys)
+				if err != nil {
+					log.Fatal(err)
+				}
+				log.Printf("Sessions will be signed with key %s after restarting", k.ID)
+			default:
+				log.Fatalf("Invalid keys option: %s", os.Args[i])
+			}
 		default:
 			log.Fatalf("Unknown command line argument: '%s'", os.Args[i])
 		}
@@ -85,39 +221,8 @@ func execArgs() {
 	}
 }
 
-func httpErr(w http.ResponseWriter, statusCode int, err error, msg ...string) {
-	if err != nil {
-		log.Output(2, err.Error())
-	}
-
-	w.WriteHeader(statusCode)
-
-	if len(msg) != 0 {
-		w.Write([]byte(msg[0]))
-	}
-}
-
-func validationErr(w http.ResponseWriter, err error) {
-	if _, ok := err.(*validator.InvalidValidationError); ok {
-		log.Output(2, err.Error())
-		w.WriteHeader(500)
-		w.Write([]byte("invalid validation error"))
-		return
-	}
-
-	var msg string
-	for _, err := range err.(validator.ValidationErrors) {
-		msg += err.Error()
-	}
-	log.Output(2, msg)
-	w.WriteHeader(400)
-	w.Write([]byte(msg))
-}
-
-func returnJSON(w http.ResponseWriter, data interface{}) {
-	j, err := json.Marshal(data)
-	if err != nil {
-		httpErr(w, 500, err)
-	}
-	w.Write(j)
+// setCookie sets the cookie on the response, marking it Secure if the request was made over TLS.
+func setCookie(w http.ResponseWriter, r *http.Request, cookie *http.Cookie) {
+	cookie.Secure = r.TLS != nil
+	http.SetCookie(w, cookie)
 }
@@ -1,29 +1,94 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"log"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/vmihailenco/msgpack/v5"
+
+	"github.com/calvinsomething/go-proj/auth"
+	"github.com/calvinsomething/go-proj/models"
 )
 
+// checkBody compares the body for successful responses, and checks that error responses are
+// problem details.
+func checkBody(t *testing.T, status int, contentType, body, want string) {
+	t.Helper()
+	if status >= 400 {
+		if contentType != problemContentType {
+			t.Fatalf("got Content-Type %q; want %q", contentType, problemContentType)
+		}
+		return
+	}
+	if body != want {
+		t.Fatalf("got %q; want %q", body, want)
+	}
+}
+
+// echo returns a handler that writes its name followed by the values of the given path params.
+func echo(name string, params ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, name)
+		for _, p := range params {
+			fmt.Fprintf(w, " %s=%s", p, pathParam(r, p))
+		}
+	}
+}
+
+func testMux() *mux {
+	m := newMux()
+	m.get("/players", echo("players"))
+	m.get("/players/{ip}", echo("player", "ip"))
+	m.get("/players/me", echo("me"))
+	m.get("/users/{email}/sessions/{id}", echo("session", "email", "id"))
+	m.get("/static/*", echo("static", "*"))
+	m.get("/files/{path*}", echo("files", "path"))
+	return m
+}
+
 var tests = []struct {
-	method  string
-	route   string
-	body    io.Reader
-	handler http.HandlerFunc
-	want    string
+	method string
+	route  string
+	body   io.Reader
+	status int
+	want   string
 }{
-	{"GET", "/players", nil, getPlayersHandler, "hi"},
+	{"GET", "/players", nil, 200, "players"},
+	{"GET", "/players/", nil, 200, "players"},
+	{"GET", "/players/10.0.0.1", nil, 200, "player ip=10.0.0.1"},
+	{"GET", "/players/10.0.0.1/", nil, 200, "player ip=10.0.0.1"},
+	{"GET", "/players/me", nil, 200, "me"},
+	{"GET", "/users/a%40b.com/sessions/42", nil, 200, "session email=a@b.com id=42"},
+	{"GET", "/static/js/main.js", nil, 200, "static *=js/main.js"},
+	{"GET", "/static", nil, 200, "static *="},
+	{"GET", "/files/a/b", nil, 200, "files path=a/b"},
+	{"GET", "/users/a@b.com/sessions", nil, 404, ""},
+	{"POST", "/players", nil, 405, ""},
 }
 
 func TestRoutes(t *testing.T) {
-	ts := httptest.NewServer(newMux())
+	ts := httptest.NewServer(testMux())
 	defer ts.Close()
 
 	for _, tc := range tests {
-		t.Run(tc.route, func(t *testing.T) {
+		t.Run(tc.method+" "+tc.route, func(t *testing.T) {
 			req, err := http.NewRequest(tc.method, ts.URL+tc.route, tc.body)
 			if err != nil {
 				t.Fatal(err.Error())
@@ -40,8 +105,1024 @@ func TestRoutes(t *testing.T) {
 				t.Fatal(err.Error())
 			}
 
-			if string(body) != tc.want {
-				t.Fatalf("got %q; want %q", body, tc.want)
+			if res.StatusCode != tc.status {
+				t.Fatalf("got status %d; want %d", res.StatusCode, tc.status)
+			}
+
+			checkBody(t, res.StatusCode, res.Header.Get("Content-Type"), string(body), tc.want)
+		})
+	}
+}
+
+func TestPatternConflict(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected conflicting patterns to panic")
+		}
+	}()
+	m := newMux()
+	m.get("/players/{ip}", echo("a"))
+	m.put("/players/{id}", echo("b"))
+}
+
+// header returns a middleware that appends the value to the "X-Trace" header and calls next.
+func header(value string) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("X-Trace", value)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func deny(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	})
+}
+
+func TestMiddleware(t *testing.T) {
+	m := newMux(header("mux"))
+	m.use("/admin/*", header("admin"), deny)
+	m.use("/players/*", header("group"))
+	m.get("/admin/users", echo("admin"))
+	m.get("/players/{ip}", echo("player"), header("route"))
+
+	cases := []struct {
+		route  string
+		status int
+		trace  []string
+	}{
+		{"/players/1", 200, []string{"mux", "group", "route"}},
+		{"/admin/users", 403, []string{"mux", "admin"}},
+		{"/admin/nothing", 403, []string{"mux", "admin"}},
+		{"/missing", 404, []string{"mux"}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.route, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			m.ServeHTTP(w, httptest.NewRequest("GET", tc.route, nil))
+
+			if w.Code != tc.status {
+				t.Fatalf("got status %d; want %d", w.Code, tc.status)
+			}
+			if got := fmt.Sprint(w.Header()["X-Trace"]); got != fmt.Sprint(tc.trace) {
+				t.Fatalf("got trace %s; want %s", got, fmt.Sprint(tc.trace))
+			}
+		})
+	}
+}
+
+func TestGroups(t *testing.T) {
+	m := newMux()
+	m.get("/players", echo("root"))
+	v1 := m.version("v1")
+	v1.get("/players", echo("v1"))
+	v2 := m.version("v2", header("v2"))
+	v2.get("/players/{ip}", echo("v2", "ip"))
+	admin := m.group("/admin")
+	admin.get("/", echo("admin"))
+	m.get("/login", echo("login"))
+	v1.group("/me").get("/characters", echo("v1 characters"))
+
+	cases := []struct {
+		route  string
+		accept string
+		status int
+		want   string
+	}{
+		{"/players", "", 200, "root"},
+		{"/players", "application/json", 200, "root"},
+		{"/api/v1/players", "", 200, "v1"},
+		{"/api/v2/players/1", "", 200, "v2 ip=1"},
+		{"/api/v2/players", "", 404, ""},
+		{"/players", "application/vnd.goproj.v1+json", 200, "v1"},
+		{"/players/1", "text/html, application/vnd.goproj.v2+json;q=0.9", 200, "v2 ip=1"},
+		{"/players", "application/vnd.goproj.v3+json", 200, "root"},
+		{"/admin", "", 200, "admin"},
+		{"/login", "application/vnd.goproj.v1+json", 200, "login"},
+		{"/me/characters", "application/vnd.goproj.v1+json", 200, "v1 characters"},
+		{"/me/players", "application/vnd.goproj.v1+json", 404, ""},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.route+" "+tc.accept, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", tc.route, nil)
+			req.Header.Set("Accept", tc.accept)
+			m.ServeHTTP(w, req)
+
+			if w.Code != tc.status {
+				t.Fatalf("got status %d; want %d", w.Code, tc.status)
+			}
+			checkBody(t, w.Code, w.Header().Get("Content-Type"), w.Body.String(), tc.want)
+		})
+	}
+}
+
+func TestRequireUser(t *testing.T) {
+	m := newMux()
+	m.get("/players", echo("players"))
+	me := m.group("/me", requireUser)
+	me.get("/characters", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(currentUser(r).Email))
+	})
+
+	cases := []struct {
+		route  string
+		user   *auth.User
+		status int
+		want   string
+	}{
+		{"/players", nil, 200, "players"},
+		{"/me/characters", nil, 401, ""},
+		{"/me/characters", &auth.User{Email: "a@b.c"}, 200, "a@b.c"},
+	}
+
+	for _, tc := range cases {
+		t.Run(fmt.Sprint(tc.route, " ", tc.user != nil), func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", tc.route, nil)
+			if tc.user != nil {
+				req = req.WithContext(auth.NewContext(req.Context(), tc.user))
+			}
+			m.ServeHTTP(w, req)
+
+			if w.Code != tc.status {
+				t.Fatalf("got status %d; want %d", w.Code, tc.status)
+			}
+			checkBody(t, w.Code, w.Header().Get("Content-Type"), w.Body.String(), tc.want)
+		})
+	}
+}
+
+func TestAuthenticateBadSession(t *testing.T) {
+	defer func(s auth.SessionStore) { auth.Store = s }(auth.Store)
+	store := auth.NewMemoryStore()
+	auth.Store = store
+	if err := auth.SetKeys(auth.Key{ID: "current", Secret: bytes.Repeat([]byte{1}, 32)}); err != nil {
+		t.Fatal(err)
+	}
+
+	handler := authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if currentUser(r) != nil {
+			t.Error("got a logged in user; want the request to continue anonymously")
+		}
+	}))
+
+	ctx := context.Background()
+	now := time.Now().UTC()
+	cases := []struct {
+		id      string
+		keyID   string
+		expired bool
+	}{
+		// a key rotated out on this server may still be set on others, so both the session and its
+		// cookie are kept
+		{"rotated", "gone", false},
+		{"forged", "current", true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.id, func(t *testing.T) {
+			rec := &auth.SessionRecord{ID: tc.id, Email: "a@b.c", KeyID: tc.keyID, Data: bytes.Repeat([]byte{2}, 64),
+				CreatedAt: now, UpdatedAt: now}
+			if err := store.Create(ctx, rec); err != nil {
+				t.Fatal(err)
+			}
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", "/players", nil)
+			r.AddCookie(&http.Cookie{Name: sessionCookie, Value: base64.RawURLEncoding.EncodeToString([]byte(tc.id))})
+			handler.ServeHTTP(w, r)
+
+			cookies := w.Result().Cookies()
+			if expired := len(cookies) == 1 && cookies[0].MaxAge < 0; expired != tc.expired || len(cookies) > 1 {
+				t.Fatalf("got cookies %v; want expired %t", cookies, tc.expired)
+			}
+			if _, err := store.Get(ctx, tc.id); (err == nil) == tc.expired {
+				t.Fatalf("got %v getting the session; want kept %t", err, !tc.expired)
+			}
+		})
+	}
+}
+
+func TestLoggerOmitsCookies(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	r := httptest.NewRequest("GET", "/players", nil)
+	r.AddCookie(&http.Cookie{Name: sessionCookie, Value: "secret-session-id"})
+	r.Header.Set("Authorization", "Bearer secret-token")
+	logger(echo("players")).ServeHTTP(httptest.NewRecorder(), r)
+
+	if out := buf.String(); !strings.Contains(out, "GET /players 200") || strings.Contains(out, "secret") {
+		t.Fatalf("got %q logged; want the request without its credentials", out)
+	}
+}
+
+func TestPurgeSessionsStops(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		purgeSessions(ctx, time.Hour)
+	}()
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("purgeSessions didn't return after its context was cancelled")
+	}
+}
+
+func TestLogoutWithoutSession(t *testing.T) {
+	w := httptest.NewRecorder()
+	logoutHandler(w, httptest.NewRequest("POST", "/logout", nil))
+
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("got status %d; want %d", w.Code, http.StatusNoContent)
+	}
+	if cookie := w.Header().Get("Set-Cookie"); !strings.HasPrefix(cookie, sessionCookie+"=;") ||
+		!strings.Contains(cookie, "Max-Age=0") {
+		t.Fatalf("got Set-Cookie %q; want the session cookie expired", cookie)
+	}
+}
+
+func TestDeleteSession(t *testing.T) {
+	store := auth.NewMemoryStore()
+	defer func(s auth.SessionStore) { auth.Store = s }(auth.Store)
+	auth.Store = store
+
+	ctx := context.Background()
+	now := time.Now()
+	var records []*auth.SessionRecord
+	for _, id := range []string{"current", "other"} {
+		rec := &auth.SessionRecord{ID: id, Email: "a@b.c", CreatedAt: now, UpdatedAt: now}
+		if err := store.Create(ctx, rec); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, rec)
+	}
+
+	m := newMux()
+	sessionRoutes(m.group("/me", requireUser))
+	cookie := &http.Cookie{Name: sessionCookie, Value: base64.RawURLEncoding.EncodeToString([]byte("current"))}
+
+	// revoking another session keeps the cookie, revoking the current one expires it
+	for i, wantExpired := range []bool{false, true} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("DELETE", fmt.Sprint("/me/sessions/", records[len(records)-1-i].PublicID), nil)
+		r.AddCookie(cookie)
+		m.ServeHTTP(w, r.WithContext(auth.NewContext(r.Context(), &auth.User{Email: "a@b.c"})))
+
+		if w.Code != http.StatusNoContent {
+			t.Fatalf("got status %d; want %d", w.Code, http.StatusNoContent)
+		}
+		cookies := w.Result().Cookies()
+		if expired := len(cookies) == 1 && cookies[0].MaxAge < 0; expired != wantExpired {
+			t.Fatalf("got cookies %v; want expired %t", cookies, wantExpired)
+		}
+	}
+}
+
+func TestVerifyBadToken(t *testing.T) {
+	for _, token := range []string{"", "a.b.c.d", "YUBiLmM.1.nokey.bWFj"} {
+		w := httptest.NewRecorder()
+		verifyHandler(w, httptest.NewRequest("GET", "/verify?token="+token, nil))
+
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("%q: got status %d; want %d", token, w.Code, http.StatusBadRequest)
+		}
+		checkBody(t, w.Code, w.Header().Get("Content-Type"), w.Body.String(), "")
+	}
+}
+
+func TestResetPasswordBadRequest(t *testing.T) {
+	validate = newValidator()
+
+	cases := []struct {
+		body string
+		want string
+	}{
+		{`{"token": "abc", "password": "weak"}`, problemValidation},
+		{`{"password": "Passw0rd!"}`, problemValidation},
+		{`{"token": "abc", "password": "Passw0rd!"}`, "about:blank"},
+	}
+
+	for _, tc := range cases {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/password/reset", strings.NewReader(tc.body))
+		req.Header.Set("Content-Type", "application/json")
+		resetPasswordHandler(w, req)
+
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("%s: got status %d; want %d", tc.body, w.Code, http.StatusBadRequest)
+		}
+		var p problem
+		if err := json.Unmarshal(w.Body.Bytes(), &p); err != nil || p.Type != tc.want {
+			t.Fatalf("%s: got problem type %q, %v; want %q", tc.body, p.Type, err, tc.want)
+		}
+	}
+}
+
+func TestMethods(t *testing.T) {
+	m := newMux()
+	m.get("/players/{ip}", echo("get"))
+	m.patch("/players/{ip}", echo("patch"))
+	m.delete("/players/{ip}", echo("delete"))
+	m.post("/player", echo("post"))
+
+	cases := []struct {
+		method string
+		route  string
+		status int
+		allow  string
+		want   string
+	}{
+		{"GET", "/players/1", 200, "", "get"},
+		{"HEAD", "/players/1", 200, "", ""},
+		{"PATCH", "/players/1", 200, "", "patch"},
+		{"OPTIONS", "/players/1", 204, "GET, HEAD, PATCH, DELETE, OPTIONS", ""},
+		{"PUT", "/players/1", 405, "GET, HEAD, PATCH, DELETE, OPTIONS", ""},
+		{"HEAD", "/player", 405, "POST, OPTIONS", ""},
+		{"TRACE", "/player", 405, "POST, OPTIONS", ""},
+	}
+
+	ts := httptest.NewServer(m)
+	defer ts.Close()
+
+	for _, tc := range cases {
+		t.Run(tc.method+" "+tc.route, func(t *testing.T) {
+			req, err := http.NewRequest(tc.method, ts.URL+tc.route, nil)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			defer res.Body.Close()
+
+			body, err := ioutil.ReadAll(res.Body)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+
+			if res.StatusCode != tc.status {
+				t.Fatalf("got status %d; want %d", res.StatusCode, tc.status)
+			}
+			if allow := res.Header.Get("Allow"); allow != tc.allow {
+				t.Fatalf("got Allow %q; want %q", allow, tc.allow)
+			}
+			checkBody(t, res.StatusCode, res.Header.Get("Content-Type"), string(body), tc.want)
+		})
+	}
+}
+
+func TestCORS(t *testing.T) {
+	m := newMux(cors(corsConfig{
+		AllowedOrigins:   []string{"http://localhost:3000"},
+		AllowedMethods:   []string{"GET", "POST"},
+		AllowedHeaders:   []string{"Content-Type"},
+		AllowCredentials: true,
+		MaxAge:           time.Minute,
+	}))
+	m.post("/player", echo("post"))
+
+	cases := []struct {
+		method  string
+		origin  string
+		status  int
+		headers map[string]string
+	}{
+		{"POST", "http://localhost:3000", 200, map[string]string{
+			"Access-Control-Allow-Origin":      "http://localhost:3000",
+			"Access-Control-Allow-Credentials": "true",
+		}},
+		{"OPTIONS", "http://localhost:3000", 204, map[string]string{
+			"Access-Control-Allow-Origin":  "http://localhost:3000",
+			"Access-Control-Allow-Methods": "GET, POST",
+			"Access-Control-Allow-Headers": "Content-Type",
+			"Access-Control-Max-Age":       "60",
+		}},
+		{"POST", "http://evil.example", 200, map[string]string{
+			"Access-Control-Allow-Origin": "",
+		}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.method+" "+tc.origin, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(tc.method, "/player", nil)
+			req.Header.Set("Origin", tc.origin)
+			if tc.method == "OPTIONS" {
+				req.Header.Set("Access-Control-Request-Method", "POST")
+			}
+			m.ServeHTTP(w, req)
+
+			if w.Code != tc.status {
+				t.Fatalf("got status %d; want %d", w.Code, tc.status)
+			}
+			for k, v := range tc.headers {
+				if got := w.Header().Get(k); got != v {
+					t.Fatalf("got %s %q; want %q", k, got, v)
+				}
+			}
+		})
+	}
+}
+
+func TestCORSAnyOrigin(t *testing.T) {
+	// credentials are never allowed for origins that are only allowed by "*"
+	m := newMux(cors(corsConfig{
+		AllowedOrigins:   []string{"http://localhost:3000", "*"},
+		AllowCredentials: true,
+	}))
+	m.post("/player", echo("post"))
+
+	for origin, want := range map[string][2]string{
+		"http://localhost:3000": {"http://localhost:3000", "true"},
+		"http://evil.example":   {"*", ""},
+	} {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/player", nil)
+		req.Header.Set("Origin", origin)
+		m.ServeHTTP(w, req)
+
+		got := [2]string{w.Header().Get("Access-Control-Allow-Origin"), w.Header().Get("Access-Control-Allow-Credentials")}
+		if got != want {
+			t.Fatalf("%s: got origin and credentials %q; want %q", origin, got, want)
+		}
+	}
+}
+
+func TestRedirectToHTTPS(t *testing.T) {
+	cases := []struct {
+		addr string
+		url  string
+		want string
+	}{
+		{":8443", "http://example.com:8080/players?faction=H", "https://example.com:8443/players?faction=H"},
+		{":443", "http://example.com/login", "https://example.com/login"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.url, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			redirectToHTTPS(tc.addr)(w, httptest.NewRequest("GET", tc.url, nil))
+
+			if w.Code != http.StatusPermanentRedirect {
+				t.Fatalf("got status %d; want %d", w.Code, http.StatusPermanentRedirect)
+			}
+			if got := w.Header().Get("Location"); got != tc.want {
+				t.Fatalf("got Location %q; want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestValidationErr(t *testing.T) {
+	validate = newValidator()
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/login", nil)
+	validationErr(w, r, validate.Struct(&login{Email: "not an email", Password: "password1"}))
+
+	var p problem
+	if err := json.Unmarshal(w.Body.Bytes(), &p); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	want := problem{
+		Type:     problemValidation,
+		Title:    "Validation Failed",
+		Status:   400,
+		Detail:   "the request failed validation",
+		Instance: "/login",
+		Errors: []fieldError{
+			{Field: "email", Rule: "email", Message: "email must be a valid email address"},
+			{Field: "password", Rule: "password",
+				Message: "password must contain a lowercase letter, an uppercase letter, a digit and a symbol"},
+		},
+	}
+	if !reflect.DeepEqual(p, want) {
+		t.Fatalf("got %+v; want %+v", p, want)
+	}
+}
+
+func TestTranslations(t *testing.T) {
+	validate = newValidator()
+	l := &login{Email: "a@b.com", Password: "Pa1!"}
+
+	cases := []struct {
+		acceptLanguage string
+		lang           string
+		want           string
+	}{
+		{"", "en", "password must be at least 8 characters in length"},
+		{"de-CH, en;q=0.5", "de", "password muss mindestens 8 Zeichen lang sein"},
+		{"en;q=0.2, fr", "fr", "password doit faire une taille minimum de 8 caractères"},
+		{"es-MX", "es", "password debe tener al menos 8 caracteres de longitud"},
+		{"ja", "en", "password must be at least 8 characters in length"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.acceptLanguage, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("POST", "/login", nil)
+			r.Header.Set("Accept-Language", tc.acceptLanguage)
+			validationErr(w, r, validate.Struct(l))
+
+			var p problem
+			if err := json.Unmarshal(w.Body.Bytes(), &p); err != nil {
+				t.Fatal(err.Error())
+			}
+
+			if lang := w.Header().Get("Content-Language"); lang != tc.lang {
+				t.Fatalf("got Content-Language %q; want %q", lang, tc.lang)
+			}
+			if len(p.Errors) != 1 || p.Errors[0].Message != tc.want {
+				t.Fatalf("got %+v; want message %q", p.Errors, tc.want)
+			}
+		})
+	}
+}
+
+// TestTranslationsCoverTags checks that every rule used to validate requests has a message in every
+// language, rather than falling back to the validator's untranslated error.
+func TestTranslationsCoverTags(t *testing.T) {
+	validate = newValidator()
+	mining := "mining"
+	zero, many := 0, 51
+
+	samples := []interface{}{
+		&models.Character{Name: "x", Realm: "", Level: 0, Race: "ogre", Class: "bard", Profession1: &mining,
+			Profession2: &mining},
+		&models.Character{Name: "Thrall1", Realm: strings.Repeat("a", 51), Level: 61, Race: "orc", Class: "shaman"},
+		&models.Player{Race: "orc", Class: "shaman", WeeklyHours: &zero},
+		&models.Player{Race: "orc", Class: "shaman", WeeklyHours: &many},
+		&models.PlayerQuery{Faction: []string{"X"}, Limit: 201},
+		&login{Email: "x", Password: "password"},
+		&login{Email: "a@b.c", Password: strings.Repeat("a", 21)},
+		&resetPassword{Password: "Pa55word!"},
+	}
+
+	// the rules used by the request types, which the samples must break between them
+	used := map[string]bool{}
+	for _, v := range []interface{}{models.Character{}, models.Player{}, models.PlayerQuery{}, login{}, resend{},
+		forgotPassword{}, resetPassword{}} {
+		typ := reflect.TypeOf(v)
+		for i := 0; i < typ.NumField(); i++ {
+			for _, rule := range strings.Split(typ.Field(i).Tag.Get("validate"), ",") {
+				if tag := strings.SplitN(rule, "=", 2)[0]; tag != "" && tag != "omitempty" && tag != "dive" {
+					used[tag] = true
+				}
+			}
+		}
+	}
+
+	broken := map[string]bool{}
+	for _, sample := range samples {
+		errs, ok := validate.Struct(sample).(validator.ValidationErrors)
+		if !ok {
+			t.Fatalf("got no validation errors for %+v", sample)
+		}
+		for _, fe := range errs {
+			broken[fe.Tag()] = true
+			for _, lang := range []string{"en", "de", "es", "fr"} {
+				trans, _ := translations.GetTranslator(lang)
+				if msg := fe.Translate(trans); msg == fe.Error() {
+					t.Errorf("%s: no message for %q on %s", lang, fe.Tag(), fe.StructNamespace())
+				}
+			}
+		}
+	}
+	for tag := range used {
+		if !broken[tag] {
+			t.Errorf("no sample breaks %q", tag)
+		}
+	}
+}
+
+func TestDecodeBody(t *testing.T) {
+	type target struct {
+		Race        string  `json:"race"`
+		WeeklyHours *int    `json:"weeklyHours"`
+		Profession1 *string `json:"profession1"`
+	}
+	hours := 12
+
+	var multipartBody bytes.Buffer
+	mw := multipart.NewWriter(&multipartBody)
+	mw.WriteField("race", "orc")
+	mw.WriteField("weeklyHours", "12")
+	mw.Close()
+
+	cases := []struct {
+		name        string
+		contentType string
+		body        string
+		status      int
+		want        target
+	}{
+		{"json", "application/json", `{"race":"orc","weeklyHours":12}`, 0, target{Race: "orc", WeeklyHours: &hours}},
+		{"no content type", "", `{"race":"orc"}`, 0, target{Race: "orc"}},
+		{"form", "application/x-www-form-urlencoded", "race=orc&weeklyHours=12&profession1=", 0,
+			target{Race: "orc", WeeklyHours: &hours}},
+		{"multipart", mw.FormDataContentType(), multipartBody.String(), 0, target{Race: "orc", WeeklyHours: &hours}},
+		{"unknown json field", "application/json", `{"race":"orc","level":60}`, 400, target{}},
+		{"unknown form field", "application/x-www-form-urlencoded", "race=orc&level=60", 400, target{}},
+		{"bad form value", "application/x-www-form-urlencoded", "weeklyHours=lots", 400, target{}},
+		{"trailing json", "application/json", `{"race":"orc"}{}`, 400, target{}},
+		{"unsupported", "text/plain", "race=orc", 415, target{}},
+		{"too large", "application/json", `"` + strings.Repeat("a", maxBodySize) + `"`, 413, target{}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/player", strings.NewReader(tc.body))
+			if tc.contentType != "" {
+				r.Header.Set("Content-Type", tc.contentType)
+			}
+
+			var got target
+			err := decodeBody(r, &got)
+			if tc.status != 0 {
+				if be, ok := err.(*bodyError); !ok || be.status != tc.status {
+					t.Fatalf("got error %v; want status %d", err, tc.status)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("got %+v; want %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestPlayerQuery(t *testing.T) {
+	hours := 5
+	cases := []struct {
+		query string
+		want  models.PlayerQuery
+		err   bool
+	}{
+		{"", models.PlayerQuery{}, false},
+		{"race=orc,troll&race=tauren", models.PlayerQuery{Race: []string{"orc", "troll", "tauren"}}, false},
+		{"faction=H&class=mage,rogue&sort=-race&limit=10", models.PlayerQuery{
+			Faction: []string{"H"}, Class: []string{"mage", "rogue"}, Sort: "-race", Limit: 10}, false},
+		{"minWeeklyHours=5&cursor=eyJ2IjoxLCJpZCI6Mn0", models.PlayerQuery{
+			MinWeeklyHours: &hours, Cursor: "eyJ2IjoxLCJpZCI6Mn0"}, false},
+		{"minWeeklyHours=lots", models.PlayerQuery{}, true},
+		{"level=60", models.PlayerQuery{}, true},
+	}
+
+	for _, tc := range cases {
+		query, err := url.ParseQuery(tc.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got models.PlayerQuery
+		err = decodeForm(splitValues(query), &got)
+		if tc.err {
+			if err == nil {
+				t.Errorf("%q: got %+v; want an error", tc.query, got)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%q: got %+v, %v; want %+v", tc.query, got, err, tc.want)
+		}
+	}
+}
+
+func TestRespond(t *testing.T) {
+	prof := "mining"
+	players := []models.Player{
+		{ID: 1, Faction: "H", Race: "orc", Class: "warrior", Profession1: &prof, Owner: "a@b.com"},
+		{ID: 2, Faction: "A", Race: "night elf", Class: "druid"},
+	}
+	packed, err := msgpack.Marshal(map[string]interface{}{"race": "orc"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	cases := []struct {
+		accept      string
+		data        interface{}
+		status      int
+		contentType string
+		want        string
+	}{
+		{"", players[:1], 200, "application/json",
+			`[{"id":1,"faction":"H","race":"orc","class":"warrior","profession1":"mining","profession2":null,"weeklyHours":null}]` + "\n"},
+		{"application/vnd.goproj.v1+json", map[string]int{"a": 1}, 200, "application/json", `{"a":1}` + "\n"},
+		{"text/csv", players, 200, "text/csv; charset=utf-8",
+			"id,faction,race,class,profession1,profession2,weeklyHours\n" +
+				"1,H,orc,warrior,mining,,\n" +
+				"2,A,night elf,druid,,,\n"},
+		{"text/csv;q=0.5, application/msgpack", map[string]string{"race": "orc"}, 200, "application/msgpack", string(packed)},
+		{"text/csv", map[string]string{"race": "orc"}, 406, problemContentType, ""},
+		{"text/html", players, 406, problemContentType, ""},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.accept, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", "/players", nil)
+			r.Header.Set("Accept", tc.accept)
+			respond(w, r, 200, tc.data)
+
+			if w.Code != tc.status {
+				t.Fatalf("got status %d; want %d", w.Code, tc.status)
+			}
+			if ct := w.Header().Get("Content-Type"); ct != tc.contentType {
+				t.Fatalf("got Content-Type %q; want %q", ct, tc.contentType)
+			}
+			checkBody(t, w.Code, w.Header().Get("Content-Type"), w.Body.String(), tc.want)
+		})
+	}
+}
+
+func TestMergePatch(t *testing.T) {
+	cases := []struct {
+		target string
+		patch  string
+		want   string
+	}{
+		{`{"race":"orc","class":"warrior"}`, `{"class":"shaman"}`, `{"class":"shaman","race":"orc"}`},
+		{`{"race":"orc","profession1":"mining"}`, `{"profession1":null}`, `{"race":"orc"}`},
+		{`{"a":{"b":1,"c":2}}`, `{"a":{"c":null,"d":3}}`, `{"a":{"b":1,"d":3}}`},
+		{`{"a":[1,2]}`, `{"a":[3]}`, `{"a":[3]}`},
+		{`{"a":1}`, `"replaced"`, `"replaced"`},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.patch, func(t *testing.T) {
+			var target, patch interface{}
+			if err := json.Unmarshal([]byte(tc.target), &target); err != nil {
+				t.Fatal(err.Error())
+			}
+			if err := json.Unmarshal([]byte(tc.patch), &patch); err != nil {
+				t.Fatal(err.Error())
+			}
+
+			got, err := json.Marshal(mergePatch(target, patch))
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			if string(got) != tc.want {
+				t.Fatalf("got %s; want %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestModelErr(t *testing.T) {
+	cases := []struct {
+		err     error
+		ifMatch string
+		status  int
+	}{
+		{models.ErrNotFound, "", http.StatusNotFound},
+		{models.ErrConflict, "", http.StatusConflict},
+		{models.ErrVersionMismatch, `"2"`, http.StatusPreconditionFailed},
+		{models.ErrVersionMismatch, "", http.StatusConflict},
+		{errors.New("connection refused"), "", http.StatusInternalServerError},
+	}
+
+	for _, tc := range cases {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("PUT", "/me/characters/1", nil)
+		if tc.ifMatch != "" {
+			r.Header.Set("If-Match", tc.ifMatch)
+		}
+		modelErr(w, r, tc.err, "character")
+		if w.Code != tc.status {
+			t.Errorf("%v: got status %d; want %d", tc.err, w.Code, tc.status)
+		}
+		checkBody(t, w.Code, w.Header().Get("Content-Type"), "", "")
+	}
+}
+
+// TestCharacterHandlers covers the responses that don't need the database.
+func TestCharacterHandlers(t *testing.T) {
+	validate = newValidator()
+	m := newMux()
+	characterRoutes(m.group("/me", requireUser))
+
+	cases := []struct {
+		name    string
+		method  string
+		route   string
+		header  string
+		body    string
+		anon    bool
+		status  int
+		invalid []string
+	}{
+		{"anonymous", "GET", "/me/characters", "", "", true, 401, nil},
+		{"get bad id", "GET", "/me/characters/abc", "", "", false, 404, nil},
+		{"get zero id", "GET", "/me/characters/0", "", "", false, 404, nil},
+		{"add bad json", "POST", "/me/characters", "", `{"name":`, false, 400, nil},
+		{"add unknown field", "POST", "/me/characters", "", `{"name":"Thrall","gold":1}`, false, 400, nil},
+		{"add invalid", "POST", "/me/characters", "",
+			`{"name":"x1","realm":"","level":61,"race":"ogre","class":"mage","profession1":"mining","profession2":"mining"}`,
+			false, 400, []string{"name", "realm", "level", "race", "profession2"}},
+		{"replace bad if-match", "PUT", "/me/characters/1", "3", `{}`, false, 412, nil},
+		{"replace bad id", "PUT", "/me/characters/abc", "", `{}`, false, 404, nil},
+		{"replace invalid", "PUT", "/me/characters/1", "",
+			`{"name":"Thrall","realm":"Durotan","level":0,"race":"orc","class":"shaman"}`, false, 400, []string{"level"}},
+		{"delete bad if-match", "DELETE", "/me/characters/1", `"3`, "", false, 412, nil},
+		{"delete bad id", "DELETE", "/me/characters/-1", "", "", false, 404, nil},
+		{"set main bad id", "PUT", "/me/characters/main/main", "", "", false, 404, nil},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(tc.method, tc.route, strings.NewReader(tc.body))
+			if tc.body != "" {
+				r.Header.Set("Content-Type", "application/json")
+			}
+			if tc.header != "" {
+				r.Header.Set("If-Match", tc.header)
+			}
+			if !tc.anon {
+				r = r.WithContext(auth.NewContext(r.Context(), &auth.User{Email: "a@b.c"}))
+			}
+			m.ServeHTTP(w, r)
+
+			if w.Code != tc.status {
+				t.Fatalf("got status %d; want %d: %s", w.Code, tc.status, w.Body)
+			}
+			checkBody(t, w.Code, w.Header().Get("Content-Type"), "", "")
+			if tc.invalid == nil {
+				return
+			}
+
+			var p problem
+			if err := json.Unmarshal(w.Body.Bytes(), &p); err != nil {
+				t.Fatal(err.Error())
+			}
+			var fields []string
+			for _, e := range p.Errors {
+				fields = append(fields, e.Field)
+			}
+			if p.Type != problemValidation || !reflect.DeepEqual(fields, tc.invalid) {
+				t.Fatalf("got %s %v; want %s %v", p.Type, fields, problemValidation, tc.invalid)
+			}
+		})
+	}
+}
+
+func TestIfMatch(t *testing.T) {
+	cases := []struct {
+		header  string
+		ok      bool
+		matches []int
+		misses  []int
+	}{
+		{"", true, []int{1, 5}, nil},
+		{"*", true, []int{1, 5}, nil},
+		{`"3"`, true, []int{3}, []int{1, 4}},
+		{`"2", "5"`, true, []int{2, 5}, []int{3}},
+		{`"2","5" , "7"`, true, []int{2, 5, 7}, []int{3}},
+		{`W/"3"`, true, nil, []int{3}},
+		{`W/"3", "4"`, true, []int{4}, []int{3}},
+		{`"a,b", "6"`, true, []int{6}, []int{1}},
+		{`"abc"`, true, nil, []int{1}},
+		{`"0"`, true, nil, []int{0}},
+		{`3`, false, nil, nil},
+		{`"3`, false, nil, nil},
+		{`"3" "4"`, false, nil, nil},
+		{`*, "3"`, false, nil, nil},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.header, func(t *testing.T) {
+			r := httptest.NewRequest("PUT", "/players/1", nil)
+			if tc.header != "" {
+				r.Header.Set("If-Match", tc.header)
+			}
+			m, ok := ifMatch(r)
+			if ok != tc.ok {
+				t.Fatalf("got %t; want %t", ok, tc.ok)
+			}
+			for _, v := range tc.matches {
+				if !m.matches(v) {
+					t.Errorf("%d doesn't match", v)
+				}
+			}
+			for _, v := range tc.misses {
+				if m.matches(v) {
+					t.Errorf("%d matches", v)
+				}
+			}
+		})
+	}
+
+	t.Run("match version", func(t *testing.T) {
+		for _, tc := range []struct {
+			header  string
+			version int
+			status  int
+		}{
+			{"", 0, 0},
+			{"*", 4, 0},
+			{`"3", "4"`, 4, 0},
+			{`"3"`, 0, http.StatusPreconditionFailed},
+		} {
+			r := httptest.NewRequest("PUT", "/players/1", nil)
+			if tc.header != "" {
+				r.Header.Set("If-Match", tc.header)
+			}
+			w := httptest.NewRecorder()
+			m, _ := ifMatch(r)
+			version, ok := matchVersion(w, r, m, 4, "player")
+			if tc.status != 0 {
+				if ok || w.Code != tc.status {
+					t.Errorf("%q: got %d; want %d", tc.header, w.Code, tc.status)
+				}
+			} else if !ok || version != tc.version {
+				t.Errorf("%q: got %d, %t; want %d", tc.header, version, ok, tc.version)
+			}
+		}
+	})
+
+	t.Run("none match", func(t *testing.T) {
+		for _, tc := range []struct {
+			header      string
+			notModified bool
+		}{
+			{"", false},
+			{`"3"`, true},
+			{`"2"`, false},
+			{`"1", "3"`, true},
+			{`W/"3"`, true},
+			{`W/"1", W/"3"`, true},
+			{"*", true},
+			{`"3`, false},
+		} {
+			r := httptest.NewRequest("GET", "/players/1", nil)
+			if tc.header != "" {
+				r.Header.Set("If-None-Match", tc.header)
+			}
+			if got := notModified(r, 3); got != tc.notModified {
+				t.Errorf("%q: got %t; want %t", tc.header, got, tc.notModified)
+			}
+		}
+	})
+
+	t.Run("multiple headers", func(t *testing.T) {
+		r := httptest.NewRequest("PUT", "/players/1", nil)
+		r.Header.Add("If-Match", `"1"`)
+		r.Header.Add("If-Match", `"2"`)
+		if m, ok := ifMatch(r); !ok || !m.matches(1) || !m.matches(2) || m.matches(3) {
+			t.Fatalf("got %+v, %t", m, ok)
+		}
+	})
+}
+
+func TestClientIP(t *testing.T) {
+	trustedProxies = parseTrustedProxies([]string{"10.0.0.0/8", "::1"})
+	defer func() { trustedProxies = nil }()
+
+	cases := []struct {
+		name       string
+		remoteAddr string
+		headers    map[string]string
+		want       string
+	}{
+		{"direct", "203.0.113.5:1234", nil, "203.0.113.5"},
+		{"ipv6", "[2001:db8::1]:1234", nil, "2001:db8::1"},
+		{"untrusted proxy", "203.0.113.5:1234", map[string]string{"X-Forwarded-For": "198.51.100.7"}, "203.0.113.5"},
+		{"trusted proxy", "10.0.0.2:1234", map[string]string{"X-Forwarded-For": "198.51.100.7"}, "198.51.100.7"},
+		{"spoofed hop", "10.0.0.2:1234", map[string]string{"X-Forwarded-For": "1.1.1.1, 198.51.100.7, 10.0.0.3"}, "198.51.100.7"},
+		{"forwarded", "[::1]:1234", map[string]string{"Forwarded": `for="[2001:db8::2]:4711";proto=https`}, "2001:db8::2"},
+		{"forwarded wins", "10.0.0.2:1234", map[string]string{
+			"Forwarded":       "for=192.0.2.60",
+			"X-Forwarded-For": "198.51.100.7",
+		}, "192.0.2.60"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tc.remoteAddr
+			for k, v := range tc.headers {
+				r.Header.Set(k, v)
+			}
+			if got := clientIP(r); got != tc.want {
+				t.Fatalf("got %q; want %q", got, tc.want)
 			}
 		})
 	}
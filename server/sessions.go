@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/calvinsomething/go-proj/auth"
+)
+
+// sessionStoreFromEnv returns the session store named by SESSION_STORE: "sql" (the default),
+// "memory", or "file", which is kept at SESSION_FILE.
+func sessionStoreFromEnv() auth.SessionStore {
+	switch store := envString("SESSION_STORE", "sql"); store {
+	case "sql":
+		return auth.SQLStore{}
+	case "memory":
+		return auth.NewMemoryStore()
+	case "file":
+		path := envString("SESSION_FILE", "sessions.gob")
+		f, err := auth.OpenFileStore(path)
+		if err != nil {
+			log.Fatalf("Could not open session file %s: %v", path, err)
+		}
+		return f
+	default:
+		log.Fatalf("Invalid SESSION_STORE: %q", store)
+		return nil
+	}
+}
+
+// previousSessionKeys is how many keys are kept to verify sessions when rotating the key file.
+// Active sessions are signed again with the new key when they are refreshed, so only sessions
+// unused through several rotations are lost.
+const previousSessionKeys = 2
+
+// setSessionKeys sets the session keys from the file at SESSION_KEY_FILE or, failing that, from
+// SESSION_KEYS. Without either, sessions don't survive restarts and can't be shared by servers.
+func setSessionKeys() {
+	var keys []auth.Key
+	var err error
+	if path := envString("SESSION_KEY_FILE", ""); path != "" {
+		keys, err = auth.ReadKeyFile(path)
+	} else if s := envString("SESSION_KEYS", ""); s != "" {
+		keys, err = auth.ParseKeys(s)
+	} else {
+		log.Println("WARNING: no SESSION_KEY_FILE or SESSION_KEYS, sessions will end when the server stops")
+		return
+	}
+	if err == nil {
+		err = auth.SetKeys(keys...)
+	}
+	if err != nil {
+		log.Fatalf("Invalid session keys: %v", err)
+	}
+}
+
+// purgeSessions deletes expired sessions and password reset tokens every interval until ctx is
+// done, so that the ones which are never used again don't pile up. The interval must be positive.
+func purgeSessions(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		n, err := auth.PurgeSessions(ctx)
+		if err != nil {
+			log.Println("UNHANDLED:", err)
+		} else if n > 0 {
+			log.Printf("Purged %d expired sessions\n", n)
+		}
+
+		n, err = auth.PurgePasswordResets(ctx)
+		if err != nil {
+			log.Println("UNHANDLED:", err)
+		} else if n > 0 {
+			log.Printf("Purged %d expired password reset tokens\n", n)
+		}
+	}
+}
+
+// sessionRoutes registers the routes for the logged in user's sessions on the "/me" group.
+func sessionRoutes(me *mux) {
+	me.get("/sessions", getSessionsHandler)
+	me.delete("/sessions", deleteSessionsHandler)
+	me.delete("/sessions/{id}", deleteSessionHandler)
+}
+
+// sessionID returns the session id from the session cookie, or "" if there is none.
+func sessionID(r *http.Request) string {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return ""
+	}
+	return cookie.Value
+}
+
+// logoutHandler deletes the current session, if there is one, and expires the cookie.
+func logoutHandler(w http.ResponseWriter, r *http.Request) {
+	if sid := sessionID(r); sid != "" {
+		if err := auth.LogOut(r.Context(), sid); err != nil && err != auth.ErrNoSession {
+			httpErr(w, r, 500, err)
+			return
+		}
+	}
+
+	expireSessionCookie(w, r)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func getSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+
+	sessions, err := auth.Sessions(r.Context(), user.Email, sessionID(r))
+	if err != nil {
+		httpErr(w, r, 500, err)
+		return
+	}
+	respond(w, r, http.StatusOK, sessions)
+}
+
+// deleteSessionHandler revokes one of the user's sessions. Revoking the current one logs out.
+func deleteSessionHandler(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+
+	id, ok := pathID(r)
+	if !ok {
+		httpErr(w, r, http.StatusNotFound, nil, "session not found")
+		return
+	}
+
+	current, err := auth.RevokeSession(r.Context(), user.Email, id, sessionID(r))
+	if err == auth.ErrNoSession {
+		httpErr(w, r, http.StatusNotFound, nil, "session not found")
+		return
+	} else if err != nil {
+		httpErr(w, r, 500, err)
+		return
+	}
+
+	if current {
+		expireSessionCookie(w, r)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// deleteSessionsHandler revokes all of the user's sessions, logging them out everywhere.
+func deleteSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+
+	if err := auth.RevokeSessions(r.Context(), user.Email); err != nil {
+		httpErr(w, r, 500, err)
+		return
+	}
+
+	expireSessionCookie(w, r)
+	w.WriteHeader(http.StatusNoContent)
+}
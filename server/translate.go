@@ -0,0 +1,169 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-playground/locales/de"
+	"github.com/go-playground/locales/en"
+	"github.com/go-playground/locales/es"
+	"github.com/go-playground/locales/fr"
+	ut "github.com/go-playground/universal-translator"
+	"github.com/go-playground/validator/v10"
+	enTranslations "github.com/go-playground/validator/v10/translations/en"
+	esTranslations "github.com/go-playground/validator/v10/translations/es"
+	frTranslations "github.com/go-playground/validator/v10/translations/fr"
+)
+
+// translations holds a translator per supported language, falling back to English. It is set
+// up by registerTranslations.
+var translations *ut.UniversalTranslator
+
+// passwordMessages are the translations for the custom "password" rule.
+var passwordMessages = map[string]string{
+	"en": "{0} must contain a lowercase letter, an uppercase letter, a digit and a symbol",
+	"de": "{0} muss einen Kleinbuchstaben, einen Großbuchstaben, eine Ziffer und ein Sonderzeichen enthalten",
+	"es": "{0} debe contener una letra minúscula, una letra mayúscula, un dígito y un símbolo",
+	"fr": "{0} doit contenir une lettre minuscule, une lettre majuscule, un chiffre et un symbole",
+}
+
+// alphaunicodeMessages are the translations for the "alphaunicode" rule, which the validator has no
+// messages for in any language.
+var alphaunicodeMessages = map[string]string{
+	"en": "{0} can only contain letters",
+	"de": "{0} darf nur Buchstaben enthalten",
+	"es": "{0} solo puede contener letras",
+	"fr": "{0} ne peut contenir que des lettres",
+}
+
+// germanMessages covers the rules used by the API, since the validator has no German defaults.
+// Rules with a "-string" variant are worded differently for string lengths.
+var germanMessages = map[string]string{
+	"required":   "{0} ist ein Pflichtfeld",
+	"email":      "{0} muss eine gültige E-Mail-Adresse sein",
+	"oneof":      "{0} muss einer der folgenden Werte sein: [{1}]",
+	"nefield":    "{0} darf nicht gleich {1} sein",
+	"eqfield":    "{0} muss gleich {1} sein",
+	"len":        "{0} muss gleich {1} sein",
+	"len-string": "{0} muss genau {1} Zeichen lang sein",
+	"min":        "{0} muss mindestens {1} sein",
+	"min-string": "{0} muss mindestens {1} Zeichen lang sein",
+	"max":        "{0} darf höchstens {1} sein",
+	"max-string": "{0} darf höchstens {1} Zeichen lang sein",
+	"gt":         "{0} muss größer als {1} sein",
+	"gte":        "{0} muss größer oder gleich {1} sein",
+	"lt":         "{0} muss kleiner als {1} sein",
+	"lte":        "{0} muss kleiner oder gleich {1} sein",
+}
+
+// registerTranslations registers the validator's messages for every supported language.
+func registerTranslations(v *validator.Validate) error {
+	translations = ut.New(en.New(), en.New(), de.New(), es.New(), fr.New())
+
+	for lang, register := range map[string]func(*validator.Validate, ut.Translator) error{
+		"en": enTranslations.RegisterDefaultTranslations,
+		"es": esTranslations.RegisterDefaultTranslations,
+		"fr": frTranslations.RegisterDefaultTranslations,
+		"de": registerGermanTranslations,
+	} {
+		trans, _ := translations.GetTranslator(lang)
+		if err := register(v, trans); err != nil {
+			return err
+		}
+		for tag, messages := range map[string]map[string]string{
+			"password":     passwordMessages,
+			"alphaunicode": alphaunicodeMessages,
+		} {
+			if err := registerTranslation(v, trans, tag, messages[lang], ""); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func registerGermanTranslations(v *validator.Validate, trans ut.Translator) error {
+	for tag, text := range germanMessages {
+		if strings.HasSuffix(tag, "-string") {
+			continue
+		}
+		if err := registerTranslation(v, trans, tag, text, germanMessages[tag+"-string"]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// registerTranslation adds a message for the tag, where {0} is the field and {1} the rule's param.
+// If stringText is not empty it is used instead for string fields.
+func registerTranslation(v *validator.Validate, trans ut.Translator, tag, text, stringText string) error {
+	return v.RegisterTranslation(tag, trans, func(trans ut.Translator) error {
+		if err := trans.Add(tag, text, true); err != nil {
+			return err
+		}
+		if stringText != "" {
+			return trans.Add(tag+"-string", stringText, true)
+		}
+		return nil
+	}, func(trans ut.Translator, fe validator.FieldError) string {
+		key := tag
+		if stringText != "" && fe.Kind() == reflect.String {
+			key = tag + "-string"
+		}
+
+		msg, err := trans.T(key, fe.Field(), fe.Param())
+		if err != nil {
+			log.Printf("could not translate %q for %s: %s", tag, trans.Locale(), err)
+			return fe.Error()
+		}
+		return msg
+	})
+}
+
+// translator picks the best supported language from the request's Accept-Language header.
+func translator(r *http.Request) ut.Translator {
+	trans, _ := translations.FindTranslator(acceptedLanguages(r)...)
+	return trans
+}
+
+// acceptedLanguages returns the languages in the Accept-Language header ordered by preference,
+// each followed by its base language, e.g. "de-CH" is followed by "de".
+func acceptedLanguages(r *http.Request) []string {
+	type lang struct {
+		tag string
+		q   float64
+	}
+
+	var langs []lang
+	for _, header := range r.Header.Values("Accept-Language") {
+		for _, part := range strings.Split(header, ",") {
+			fields := strings.Split(strings.TrimSpace(part), ";")
+			l := lang{tag: strings.TrimSpace(fields[0]), q: 1}
+			for _, param := range fields[1:] {
+				if v := strings.TrimSpace(param); strings.HasPrefix(v, "q=") {
+					if q, err := strconv.ParseFloat(v[2:], 64); err == nil {
+						l.q = q
+					}
+				}
+			}
+			if l.tag != "" && l.tag != "*" && l.q > 0 {
+				langs = append(langs, l)
+			}
+		}
+	}
+	sort.SliceStable(langs, func(i, j int) bool { return langs[i].q > langs[j].q })
+
+	var tags []string
+	for _, l := range langs {
+		tag := strings.ReplaceAll(l.tag, "-", "_")
+		tags = append(tags, tag)
+		if base := strings.ToLower(strings.SplitN(tag, "_", 2)[0]); base != tag {
+			tags = append(tags, base)
+		}
+	}
+	return tags
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+
+	"github.com/calvinsomething/go-proj/auth"
+)
+
+type resend struct {
+	Email string `json:"email" validate:"email"`
+}
+
+// verifyRoutes registers the email verification routes.
+func verifyRoutes(m *mux) {
+	m.get("/verify", verifyHandler)
+	m.post("/verify/resend", resendVerificationHandler)
+}
+
+// sendVerification emails a verification link to the user.
+func sendVerification(r *http.Request, email string) error {
+	token, err := auth.VerificationToken(r.Context(), email)
+	if err != nil {
+		return err
+	}
+
+	return sendMail(r, email, "verify", linkMail{
+		Link:  publicURL + "/verify?token=" + url.QueryEscape(token),
+		Hours: hours(auth.VerificationTTL),
+	})
+}
+
+// verifyHandler activates the account in the token from a verification email.
+func verifyHandler(w http.ResponseWriter, r *http.Request) {
+	err := auth.Verify(r.Context(), r.URL.Query().Get("token"))
+	switch err {
+	case nil:
+		w.WriteHeader(http.StatusNoContent)
+	case auth.ErrBadToken, auth.ErrTokenExpired:
+		httpErr(w, r, 400, err)
+	case auth.ErrNoUser:
+		httpErr(w, r, http.StatusNotFound, err)
+	default:
+		httpErr(w, r, 500, err)
+	}
+}
+
+// resendVerificationHandler emails a new verification link. It responds the same whether or not the
+// email needs verifying, or was sent one too recently, so that it can't be used to find users.
+func resendVerificationHandler(w http.ResponseWriter, r *http.Request) {
+	var body resend
+	if err := decodeBody(r, &body); err != nil {
+		decodeErr(w, r, err)
+		return
+	}
+
+	if err := validate.Struct(&body); err != nil {
+		validationErr(w, r, err)
+		return
+	}
+
+	// throttled resends are skipped silently, since only users who exist can be throttled
+	var throttled *auth.ThrottledError
+	err := sendVerification(r, body.Email)
+	if err != nil && err != auth.ErrNoUser && err != auth.ErrVerified && !errors.As(err, &throttled) {
+		log.Println("UNHANDLED:", err)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}